@@ -13,9 +13,70 @@ const DEFAULT_CONFIG = `
 log_level: warn
 cmd_whitelist:
 cmd_blacklist:
+allowed_mutating_commands: [] # e.g. [systemctl restart, tee]
+allow_output_redirects: false
+policy_file:
+environment:
+provider: openai
+fallback_providers: []
+providers:
+  openai:
+    type: openai
+    api_key_env: OPENAI_API_KEY
+    model: gpt-4.1-mini
+  azure:
+    type: azure
+    api_key_env: AZURE_OPENAI_API_KEY
+    model: gpt-4.1-mini
+  anthropic:
+    type: anthropic
+    api_key_env: ANTHROPIC_API_KEY
+    model: claude-sonnet-4-20250514
+  ollama:
+    type: ollama
+  llamacpp:
+    type: llamacpp
+    api_key_env: LLAMACPP_API_KEY
+analysis_model:
+summary_model:
+review_model:
 base_url:
 azure_openai_api_version: "2024-12-01-preview"
 azure_openai_endpoint:
+model_options: [] # Generation parameters per model
+model_pricing: # USD per million tokens
+  - model: gpt-4.1-mini
+    input_per_million: 0.40
+    output_per_million: 1.60
+  - model: gpt-4o
+    input_per_million: 2.50
+    output_per_million: 10.00
+  - model: claude-sonnet-4-20250514
+    input_per_million: 3.00
+    output_per_million: 15.00
+max_tokens_per_session: 0
+max_cost_per_session: 0
+context_budget_fraction: 0.5
+investigation_mode: batch
+max_tool_steps: 15
+safety_review: false
+unsafe_commands: reject
+injection_detection: true
+redaction: true
+redact_high_entropy: true
+redaction_rules: [] # Additional secrets, e.g. {name: customer_id, pattern: "CUST-[0-9]{6}"}
+output_head_bytes: 1024
+output_tail_bytes: 1024
+output_rules: [] # Limits of the commands starting with a pattern, e.g. {pattern: journalctl, head_bytes: 256, tail_bytes: 4096}
+spill_outputs: true
+replay_similarity_threshold: 0.8
+prompts_dir:
+save_session: false
+json_max_repairs: 2
+llm_timeout: 120s
+llm_max_retries: 3
+llm_retry_initial_backoff: 1s
+llm_retry_max_backoff: 30s
 initial_commands:
   - "top -b -n1 | head -20"
   - "ps aux | head -10"
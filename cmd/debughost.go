@@ -1,12 +1,16 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 
-	markdown "github.com/MichaelMure/go-term-markdown"
-	"github.com/remijnoel/ailops/llm"
+	"github.com/remijnoel/ailops/executor"
 	"github.com/remijnoel/ailops/models"
+	"github.com/remijnoel/ailops/redact"
 	"github.com/remijnoel/ailops/report"
 	"github.com/remijnoel/ailops/workflow"
 	log "github.com/sirupsen/logrus"
@@ -25,34 +29,10 @@ var debugCmd = &cobra.Command{
 	Short: "Diagnose an issue on a host",
 	Run: func(cmd *cobra.Command, args []string) {
 		log.Info("Starting host diagnostics...")
-		baseURL, _ := cmd.Flags().GetString("base-url")
-		if baseURL == "" {
-			baseURL = viper.GetString("base_url")
-		}
-		useAzure, _ := cmd.Flags().GetBool("azure")
-		var azureConfig *llm.AzureConfig
-
-		if useAzure {
-			log.Info("Using Azure OpenAI for diagnostics")
-			azureConfig = &llm.AzureConfig{
-				APIKey:     os.Getenv("AZURE_OPENAI_API_KEY"),
-				Endpoint:   viper.GetString("azure_openai_endpoint"),
-				APIVersion: viper.GetString("azure_openai_api_version"),
-			}
-		}
-
-		op := llm.NewOpenAIProvider(
-			llm.OpenAIProviderConfig{
-				APIKey:       os.Getenv("OPENAI_API_KEY"),
-				SystemPrompt: "You are a Linux system assistant. Analyze the following system diagnostics and provide a clear, concise summary of system health, notable issues, and recommended actions.",
-				Model:        llm.OPENAI_GPT41_Mini, // Using a smaller model for faster response times
-				AzureConfig:  azureConfig,
-				BaseUrl:      baseURL,
-			},
-		)
+		loadPrompts()
+		providers := newProviders(cmd)
 
 		interactive, _ := cmd.Flags().GetBool("interactive")
-		remote, _ := cmd.Flags().GetString("remote")
 		useSudo, _ := cmd.Flags().GetBool("sudo")
 		generateReport, _ := cmd.Flags().GetBool("generate-report")
 
@@ -67,20 +47,121 @@ var debugCmd = &cobra.Command{
 		blacklist := viper.GetStringSlice("cmd_blacklist")
 		log.Debug("Command blacklist: ", blacklist)
 
+		var pricing []models.ModelPrice
+		if err := viper.UnmarshalKey("model_pricing", &pricing); err != nil {
+			log.Fatalf("Invalid model_pricing configuration: %v", err)
+		}
+
+		mode := stringFlagOrConfig(cmd, "mode", "investigation_mode")
+		if mode != workflow.INVESTIGATION_MODE_BATCH && mode != workflow.INVESTIGATION_MODE_TOOLS {
+			log.Fatalf("Invalid investigation mode %q, supported modes are %s and %s", mode, workflow.INVESTIGATION_MODE_BATCH, workflow.INVESTIGATION_MODE_TOOLS)
+		}
+
+		safetyReview := viper.GetBool("safety_review")
+		if review, _ := cmd.Flags().GetBool("review"); review {
+			safetyReview = true
+		}
+		unsafeCommands := viper.GetString("unsafe_commands")
+		if unsafeCommands != workflow.UNSAFE_COMMANDS_REJECT && unsafeCommands != workflow.UNSAFE_COMMANDS_CONFIRM {
+			log.Fatalf("Invalid unsafe_commands %q, supported values are %s and %s", unsafeCommands, workflow.UNSAFE_COMMANDS_REJECT, workflow.UNSAFE_COMMANDS_CONFIRM)
+		}
+
+		var redactor *redact.Redactor
+		if viper.GetBool("redaction") {
+			var rules []redact.Rule
+			if err := viper.UnmarshalKey("redaction_rules", &rules); err != nil {
+				log.Fatalf("Invalid redaction_rules configuration: %v", err)
+			}
+			var err error
+			redactor, err = redact.New(rules, viper.GetBool("redact_high_entropy"))
+			if err != nil {
+				log.Fatalf("Invalid redaction_rules configuration: %v", err)
+			}
+		}
+
+		outputLimits := executor.Limits{HeadBytes: viper.GetInt("output_head_bytes"), TailBytes: viper.GetInt("output_tail_bytes")}
+		var outputRules []models.OutputRule
+		if err := viper.UnmarshalKey("output_rules", &outputRules); err != nil {
+			log.Fatalf("Invalid output_rules configuration: %v", err)
+		}
+		if !validLimits(outputLimits.HeadBytes, outputLimits.TailBytes) {
+			log.Fatalf("Invalid output_head_bytes and output_tail_bytes: they cannot be negative or both 0")
+		}
+		for _, rule := range outputRules {
+			if rule.Pattern == "" || !validLimits(rule.HeadBytes, rule.TailBytes) {
+				log.Fatalf("Invalid output_rules entry %+v: a pattern is required, and head_bytes and tail_bytes cannot be negative or both 0", rule)
+			}
+		}
+		spillDir := ""
+		if viper.GetBool("spill_outputs") {
+			spillDir = filepath.Join(".ailops", "outputs")
+		}
+
+		target, err := executor.New(targetFlag(cmd))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer target.Close()
+
 		// Define commands to run for debugging the host
 		commands := viper.GetStringSlice("initial_commands")
 		log.Debug("Initial commands from config: ", commands)
 
-		session := workflow.DebugWorkflow(description, &models.DebugSessionConfig{
-			FirstCommands:    commands,
-			Remote:           remote,
-			UseSudo:          useSudo,
-			CommandWhitelist: whitelist,
-			CommandBlacklist: blacklist,
-		}, interactive, op)
+		// Cancel in-flight commands and LLM calls on Ctrl-C
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		go func() {
+			<-ctx.Done()
+			stop() // A second Ctrl-C falls back to the default behaviour and exits immediately
+		}()
+
+		session := workflow.DebugWorkflow(ctx, description, &models.DebugSessionConfig{
+			FirstCommands:         commands,
+			Remote:                target.Target(),
+			UseSudo:               useSudo,
+			CommandWhitelist:      whitelist,
+			CommandBlacklist:      blacklist,
+			ModelPricing:          pricing,
+			MaxTokensPerSession:   viper.GetInt("max_tokens_per_session"),
+			MaxCostPerSession:     viper.GetFloat64("max_cost_per_session"),
+			ContextBudgetFraction: viper.GetFloat64("context_budget_fraction"),
+			InvestigationMode:     mode,
+			MaxToolSteps:          viper.GetInt("max_tool_steps"),
+			SafetyReview:          safetyReview,
+			UnsafeCommands:        unsafeCommands,
+
+			AllowedMutatingCommands: viper.GetStringSlice("allowed_mutating_commands"),
+			AllowOutputRedirects:    viper.GetBool("allow_output_redirects"),
+			Environment:             stringFlagOrConfig(cmd, "env", "environment"),
+			Policy:                  loadPolicy(),
+			Executor:                target,
+
+			DisableInjectionDetection: !viper.GetBool("injection_detection"),
+			Redactor:                  redactor,
+
+			OutputLimits: outputLimits,
+			OutputRules:  outputRules,
+			SpillDir:     spillDir,
+		}, interactive, providers)
+
+		// If it does not exist, create the sessions and reports directory named .ailops
+		if _, err := os.Stat(".ailops"); os.IsNotExist(err) {
+			err := os.Mkdir(".ailops", 0755)
+			if err != nil {
+				log.Fatalf("Failed to create .ailops directory: %v", err)
+			}
+		}
 
-		rendered := markdown.Render(session.Summary, 100, 2)
-		fmt.Println(string(rendered))
+		// Keep the session when asked, so that prompts can be rendered with it later
+		saveSessionFile := viper.GetBool("save_session")
+		if save, _ := cmd.Flags().GetBool("save-session"); save {
+			saveSessionFile = true
+		}
+		if saveSessionFile {
+			if err := saveSession(session); err != nil {
+				log.Errorf("Failed to save the session: %v", err)
+			}
+		}
 
 		if generateReport {
 			// For now always use markdown for reports
@@ -91,14 +172,6 @@ var debugCmd = &cobra.Command{
 			}
 			report := report.GenerateReport(session, reportConfig)
 
-			// If it does not exist, create the reports directory named .ailops
-			if _, err := os.Stat(".ailops"); os.IsNotExist(err) {
-				err := os.Mkdir(".ailops", 0755)
-				if err != nil {
-					log.Fatalf("Failed to create .ailops directory: %v", err)
-				}
-			}
-
 			reportFile := fmt.Sprintf(".ailops/debug_report_%s.md", session.ID)
 			err := os.WriteFile(reportFile, []byte(report), 0644)
 			if err != nil {
@@ -109,14 +182,44 @@ var debugCmd = &cobra.Command{
 	},
 }
 
+// validLimits tells whether the head and tail bytes kept from an output are valid
+func validLimits(headBytes, tailBytes int) bool {
+	return headBytes >= 0 && tailBytes >= 0 && headBytes+tailBytes > 0
+}
+
+// targetFlag returns the target set by --target, or by the deprecated --remote
+func targetFlag(cmd *cobra.Command) string {
+	if target, _ := cmd.Flags().GetString("target"); target != "" {
+		return target
+	}
+	remote, _ := cmd.Flags().GetString("remote")
+	return remote
+}
+
 func init() {
 	RootCmd.AddCommand(debugCmd)
 	debugCmd.Flags().StringP("description", "d", "", "Description of the issue to debug")
 	debugCmd.MarkFlagRequired("description")
 	debugCmd.Flags().BoolP("interactive", "i", false, "Run in interactive mode (default: false)")
+	debugCmd.Flags().StringP("target", "t", "", "Where to run the commands: ssh://user@host:port, docker://container, k8s://namespace/pod/container or local:// (default: local://)")
 	debugCmd.Flags().StringP("remote", "r", "", "Execute commands on a remote host (ssh format 'user@host') instead of locally")
+	debugCmd.Flags().MarkDeprecated("remote", "use --target ssh://user@host instead")
+	debugCmd.MarkFlagsMutuallyExclusive("target", "remote")
 	debugCmd.Flags().BoolP("sudo", "s", false, "Run all commands with sudo (default: false)")
+	debugCmd.Flags().String("env", "", "Environment of the host, matched by the environments of the policy rules (default: environment from the configuration)")
 	debugCmd.Flags().BoolP("generate-report", "g", false, "Generate a report after debugging (default: false)")
-	debugCmd.Flags().Bool("azure", false, "Use Azure OpenAI instead of OpenAI (default: false)")
-	debugCmd.Flags().StringP("base-url", "b", "", "Base URL for the OpenAI API (optional, e.g., https://api.openai.com/v1)")
+	debugCmd.Flags().Bool("save-session", false, "Save the session, command outputs included, to .ailops/session_<id>.json (default: save_session from the configuration)")
+	debugCmd.Flags().Bool("azure", false, "Use Azure OpenAI instead of OpenAI, same as --provider azure (default: false)")
+	debugCmd.Flags().StringP("base-url", "b", "", "Base URL for the LLM API (optional, e.g., https://api.openai.com/v1)")
+	debugCmd.Flags().StringP("provider", "p", "", "Name of the provider profile to use from the providers configuration (default: openai)")
+	debugCmd.Flags().StringP("model", "m", "", "Model to use, overrides the model of the provider profile")
+	debugCmd.Flags().String("analysis-model", "", "Model analyzing the output of each batch of commands (default: the provider model)")
+	debugCmd.Flags().String("summary-model", "", "Model writing the final analysis (default: the provider model)")
+	debugCmd.Flags().Bool("review", false, "Review the recommended commands with a second LLM call before running them (default: safety_review from the configuration)")
+	debugCmd.Flags().String("review-model", "", "Model reviewing the recommended commands (default: the analysis model)")
+	debugCmd.Flags().String("mode", "", "Investigation mode: 'batch' runs the batches of commands recommended by the model, 'tools' lets the model call tools one at a time (default: batch)")
+	debugCmd.Flags().StringSlice("fallback", nil, "Provider profiles to try in order when the selected provider fails (default: fallback_providers from the configuration)")
+	debugCmd.Flags().String("record", "", "Record the LLM requests and responses to this cassette file")
+	debugCmd.Flags().String("replay", "", "Answer the LLM requests from this cassette file instead of calling the provider")
+	debugCmd.MarkFlagsMutuallyExclusive("record", "replay")
 }
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/remijnoel/ailops/executor"
+	"github.com/remijnoel/ailops/models"
+	"github.com/remijnoel/ailops/policy"
+	"github.com/remijnoel/ailops/workflow"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var policyCmd = &cobra.Command{
+	Use:   "policy",
+	Short: "Inspect the command policy",
+	Long: `Inspect the command policy applied to the commands recommended by the LLM.
+
+The policy file set by the policy_file configuration key holds allow and deny rules
+evaluated in order on each simple command, the first matching rule deciding.`,
+}
+
+var testPolicyCmd = &cobra.Command{
+	Use:   "test <command>",
+	Short: "Explain whether a command is allowed and which rules matched",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		file, _ := cmd.Flags().GetString("file")
+		if file != "" {
+			viper.Set("policy_file", file)
+		}
+		target, err := executor.New(targetFlag(cmd))
+		if err != nil {
+			log.Fatal(err)
+		}
+		conf := &models.DebugSessionConfig{
+			Remote:                  target.Target(),
+			CommandWhitelist:        viper.GetStringSlice("cmd_whitelist"),
+			CommandBlacklist:        viper.GetStringSlice("cmd_blacklist"),
+			AllowedMutatingCommands: viper.GetStringSlice("allowed_mutating_commands"),
+			AllowOutputRedirects:    viper.GetBool("allow_output_redirects"),
+			Environment:             stringFlagOrConfig(cmd, "env", "environment"),
+			Policy:                  loadPolicy(),
+			Executor:                target,
+		}
+		if conf.Policy == nil {
+			fmt.Println("No policy file, only the command restrictions of the configuration apply")
+		}
+
+		decisions, err := workflow.ExplainCommand(args[0], conf)
+		for _, d := range decisions {
+			line := fmt.Sprintf("%-6s %s: %s", d.Decision.Action, d.Command, d.Decision)
+			if d.Decision.Rule != nil {
+				line += fmt.Sprintf(" (#%d)", d.Decision.Index)
+			}
+			fmt.Println(line)
+		}
+		if err != nil {
+			fmt.Printf("Command rejected: %v\n", err)
+			return
+		}
+		fmt.Println("Command allowed")
+	},
+}
+
+// loadPolicy reads the policy file set by policy_file, nil when there is none
+func loadPolicy() *policy.Policy {
+	file := viper.GetString("policy_file")
+	if file == "" {
+		return nil
+	}
+	p, err := policy.Load(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return p
+}
+
+func init() {
+	policyCmd.AddCommand(testPolicyCmd)
+	testPolicyCmd.Flags().String("file", "", "Policy file to test (default: policy_file from the configuration)")
+	testPolicyCmd.Flags().StringP("target", "t", "", "Target the command would run on, e.g. ssh://user@host, its host is matched by the hosts of the rules")
+	testPolicyCmd.Flags().String("env", "", "Environment of the host, matched by the environments of the rules (default: environment from the configuration)")
+
+	RootCmd.AddCommand(policyCmd)
+}
@@ -0,0 +1,190 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/remijnoel/ailops/models"
+	"github.com/remijnoel/ailops/workflow"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var promptsCmd = &cobra.Command{
+	Use:   "prompts",
+	Short: "Inspect and customize the prompt templates",
+	Long: `Inspect and customize the prompt templates sent to the LLM.
+
+The templates of the directory set by the prompts_dir configuration key replace the
+compiled-in ones. Each file is named after the prompt, e.g. command_analysis.tmpl, and
+uses the Go text/template syntax.`,
+}
+
+var listPromptsCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the prompt templates",
+	Run: func(cmd *cobra.Command, args []string) {
+		loadPrompts()
+		for _, p := range workflow.Prompts {
+			source := "default"
+			if p.Source != "" {
+				source = p.Source
+			}
+			fmt.Printf("%-20s %s (%s)\n", p.Name, p.Description, source)
+		}
+	},
+}
+
+var showPromptCmd = &cobra.Command{
+	Use:   "show <name>",
+	Short: "Print the template of a prompt",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		loadPrompts()
+		prompt, err := workflow.LookupPrompt(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if useDefault, _ := cmd.Flags().GetBool("default"); useDefault {
+			fmt.Println(prompt.Default)
+			return
+		}
+		fmt.Println(prompt.Text())
+	},
+}
+
+var exportPromptsCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Write the default prompt templates to a directory, to use as a starting point",
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		if output == "" {
+			output = viper.GetString("prompts_dir")
+		}
+		if output == "" {
+			log.Fatal("No output directory, use --output or set prompts_dir in the configuration")
+		}
+		force, _ := cmd.Flags().GetBool("force")
+
+		if err := os.MkdirAll(output, 0755); err != nil {
+			log.Fatalf("Failed to create output directory: %s", err)
+		}
+		for _, p := range workflow.Prompts {
+			path := filepath.Join(output, p.Name+workflow.PROMPT_FILE_EXTENSION)
+			if _, err := os.Stat(path); err == nil && !force {
+				log.Warnf("Skipping %s, the file already exists (use --force to overwrite it)", path)
+				continue
+			}
+			if err := os.WriteFile(path, []byte(p.Default), 0644); err != nil {
+				log.Fatalf("Failed to write %s: %v", path, err)
+			}
+			fmt.Println(path)
+		}
+	},
+}
+
+var validatePromptsCmd = &cobra.Command{
+	Use:   "validate [dir]",
+	Short: "Check that the templates of a prompts directory render (default: prompts_dir)",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		dir := viper.GetString("prompts_dir")
+		if len(args) > 0 {
+			dir = args[0]
+		}
+		if dir == "" {
+			log.Fatal("No prompts directory, pass one or set prompts_dir in the configuration")
+		}
+		if err := workflow.LoadPrompts(dir); err != nil {
+			log.Fatalf("Invalid prompt templates:\n%v", err)
+		}
+		for _, p := range workflow.Prompts {
+			if p.Source != "" {
+				fmt.Printf("%-20s OK (%s)\n", p.Name, p.Source)
+			}
+		}
+	},
+}
+
+var renderPromptCmd = &cobra.Command{
+	Use:   "render <name>",
+	Short: "Render a prompt with the data of a saved session",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		loadPrompts()
+		prompt, err := workflow.LookupPrompt(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		id, _ := cmd.Flags().GetString("session")
+		session, err := loadSession(id)
+		if err != nil {
+			log.Fatalf("Failed to load the session: %v", err)
+		}
+		rendered, err := prompt.Render(session)
+		if err != nil {
+			log.Fatalf("Failed to render the %s prompt: %v", prompt.Name, err)
+		}
+		fmt.Println(rendered)
+	},
+}
+
+// loadPrompts replaces the compiled-in prompts by the templates of prompts_dir
+func loadPrompts() {
+	dir := viper.GetString("prompts_dir")
+	if dir == "" {
+		return
+	}
+	if err := workflow.LoadPrompts(dir); err != nil {
+		log.Fatalf("Invalid prompt templates:\n%v", err)
+	}
+}
+
+func sessionFile(id string) string {
+	return filepath.Join(".ailops", fmt.Sprintf("session_%s.json", id))
+}
+
+func saveSession(session *models.DebugSessionLog) error {
+	data, err := json.MarshalIndent(session, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode the session: %w", err)
+	}
+	// The session holds the command outputs, keep it private
+	return os.WriteFile(sessionFile(session.ID), data, 0600)
+}
+
+func loadSession(id string) (*models.DebugSessionLog, error) {
+	data, err := os.ReadFile(sessionFile(id))
+	if err != nil {
+		return nil, err
+	}
+	var session models.DebugSessionLog
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("invalid session file: %w", err)
+	}
+	if len(session.Batches) == 0 {
+		return nil, fmt.Errorf("the session has no batch")
+	}
+	if session.Config == nil {
+		session.Config = &models.DebugSessionConfig{}
+	}
+	return &session, nil
+}
+
+func init() {
+	promptsCmd.AddCommand(listPromptsCmd)
+	promptsCmd.AddCommand(showPromptCmd)
+	showPromptCmd.Flags().Bool("default", false, "Print the compiled-in template instead of the one in use")
+	promptsCmd.AddCommand(exportPromptsCmd)
+	exportPromptsCmd.Flags().StringP("output", "o", "", "Output directory (default: prompts_dir)")
+	exportPromptsCmd.Flags().Bool("force", false, "Overwrite the existing files")
+	promptsCmd.AddCommand(validatePromptsCmd)
+	promptsCmd.AddCommand(renderPromptCmd)
+	renderPromptCmd.Flags().String("session", "", "ID of a session saved in the .ailops directory")
+	renderPromptCmd.MarkFlagRequired("session")
+
+	RootCmd.AddCommand(promptsCmd)
+}
@@ -0,0 +1,206 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/remijnoel/ailops/llm"
+	"github.com/remijnoel/ailops/workflow"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// newProviders builds the analysis, summary and review providers from the profile selected with
+// --provider (or the provider config key), each with its own model when configured.
+// When fallback providers are configured, each request goes to them in order when the
+// selected provider fails. With --record the requests are recorded to a cassette, with --replay they are answered
+// from one.
+func newProviders(cmd *cobra.Command) workflow.Providers {
+	profile := selectedProfile(cmd)
+
+	analysisProfile := profile
+	if model := stringFlagOrConfig(cmd, "analysis-model", "analysis_model"); model != "" {
+		analysisProfile.Model = model
+	}
+	summaryProfile := profile
+	if model := stringFlagOrConfig(cmd, "summary-model", "summary_model"); model != "" {
+		summaryProfile.Model = model
+	}
+	reviewProfile := analysisProfile
+	if model := stringFlagOrConfig(cmd, "review-model", "review_model"); model != "" {
+		reviewProfile.Model = model
+	}
+
+	build := newProvider
+	if replayPath, _ := cmd.Flags().GetString("replay"); replayPath != "" {
+		// The answers come from the cassette, neither the providers nor their fallbacks are needed
+		cassette, err := llm.LoadCassette(replayPath)
+		if err != nil {
+			log.Fatalf("Failed to load the replay cassette: %v", err)
+		}
+		log.Infof("Replaying LLM responses from %s", replayPath)
+		build = func(profile llm.ProviderProfile) llm.Provider {
+			return llm.NewReplayProvider(cassette, profile.ResolveModel(), viper.GetFloat64("replay_similarity_threshold"))
+		}
+	} else {
+		if names := fallbackProviderNames(cmd); len(names) > 0 {
+			fallbacks := make([]llm.NamedProvider, 0, len(names))
+			for _, name := range names {
+				fallbackProfile, err := loadProfile(name)
+				if err != nil {
+					log.Fatalf("Failed to load fallback provider configuration: %v", err)
+				}
+				fallbacks = append(fallbacks, llm.NamedProvider{Name: fallbackProfile.Name, Provider: newProvider(fallbackProfile)})
+			}
+			log.Infof("Falling back to providers %s when %s fails", strings.Join(names, ", "), profile.Name)
+			build = func(profile llm.ProviderProfile) llm.Provider {
+				chain := append([]llm.NamedProvider{{Name: profile.Name, Provider: newProvider(profile)}}, fallbacks...)
+				return llm.NewFallbackProvider(chain...)
+			}
+		}
+		if recordPath, _ := cmd.Flags().GetString("record"); recordPath != "" {
+			cassette := llm.NewCassette(recordPath)
+			log.Infof("Recording LLM responses to %s", recordPath)
+			buildRecorded := build
+			build = func(profile llm.ProviderProfile) llm.Provider {
+				return llm.NewRecordingProvider(buildRecorded(profile), cassette)
+			}
+		}
+	}
+
+	analysis := build(analysisProfile)
+	summary := analysis
+	if summaryProfile.Model != analysisProfile.Model {
+		summary = build(summaryProfile)
+	}
+	review := analysis
+	if reviewProfile.Model != analysisProfile.Model {
+		review = build(reviewProfile)
+	}
+	return workflow.Providers{Analysis: analysis, Summary: summary, Review: review}
+}
+
+func newProvider(profile llm.ProviderProfile) llm.Provider {
+	log.Infof("Using provider %s (type %s, model %s)", profile.Name, profile.Type, profile.Model)
+	profile.Options = modelOptions(profile)
+	provider, err := llm.NewProviderFromProfile(profile, providerOptions())
+	if err != nil {
+		log.Fatalf("Failed to create LLM provider: %v", err)
+	}
+	return provider
+}
+
+// selectedProfile returns the provider profile selected on the command line, with the flag overrides applied
+func selectedProfile(cmd *cobra.Command) llm.ProviderProfile {
+	profileName, _ := cmd.Flags().GetString("provider")
+	if profileName == "" {
+		profileName = viper.GetString("provider")
+	}
+	if useAzure, _ := cmd.Flags().GetBool("azure"); useAzure {
+		profileName = "azure"
+	}
+
+	profile, err := loadProfile(profileName)
+	if err != nil {
+		log.Fatalf("Failed to load provider configuration: %v", err)
+	}
+	if baseURL, _ := cmd.Flags().GetString("base-url"); baseURL != "" {
+		profile.BaseURL = baseURL
+	}
+	if model, _ := cmd.Flags().GetString("model"); model != "" {
+		profile.Model = model
+	}
+	return profile
+}
+
+// fallbackProviderNames returns the profiles to fall back to, from --fallback or the fallback_providers config key
+func fallbackProviderNames(cmd *cobra.Command) []string {
+	if names, _ := cmd.Flags().GetStringSlice("fallback"); len(names) > 0 {
+		return names
+	}
+	return viper.GetStringSlice("fallback_providers")
+}
+
+// modelOptions returns the options of the profile, overridden by the entry of the
+// model_options config section for the model of the profile
+func modelOptions(profile llm.ProviderProfile) map[string]string {
+	var entries []map[string]string
+	if err := viper.UnmarshalKey("model_options", &entries); err != nil {
+		log.Fatalf("Invalid model_options configuration: %v", err)
+	}
+
+	options := map[string]string{}
+	for key, value := range profile.Options {
+		options[key] = value
+	}
+	for _, entry := range entries {
+		if entry["model"] == "" || entry["model"] != profile.Model {
+			continue
+		}
+		for key, value := range entry {
+			if key != "model" {
+				options[key] = value
+			}
+		}
+	}
+	return options
+}
+
+func stringFlagOrConfig(cmd *cobra.Command, flag string, key string) string {
+	if value, _ := cmd.Flags().GetString(flag); value != "" {
+		return value
+	}
+	return viper.GetString(key)
+}
+
+// loadProfile reads a named profile from the providers config section
+func loadProfile(name string) (llm.ProviderProfile, error) {
+	profiles := map[string]llm.ProviderProfile{}
+	if err := viper.UnmarshalKey("providers", &profiles); err != nil {
+		return llm.ProviderProfile{}, fmt.Errorf("invalid providers section: %w", err)
+	}
+
+	// Viper lowercases keys
+	profile, ok := profiles[strings.ToLower(name)]
+	if !ok {
+		names := make([]string, 0, len(profiles))
+		for n := range profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return llm.ProviderProfile{}, fmt.Errorf("unknown provider %q, configured providers are: %s", name, strings.Join(names, ", "))
+	}
+	profile.Name = name
+	if profile.Type == "" {
+		profile.Type = profile.Name
+	}
+
+	// Keep supporting the settings from before provider profiles existed
+	if profile.Type == "azure" {
+		if profile.BaseURL == "" {
+			profile.BaseURL = viper.GetString("azure_openai_endpoint")
+		}
+		if profile.APIVersion == "" {
+			profile.APIVersion = viper.GetString("azure_openai_api_version")
+		}
+	} else if profile.BaseURL == "" {
+		profile.BaseURL = viper.GetString("base_url")
+	}
+
+	return profile, nil
+}
+
+func providerOptions() llm.ProviderOptions {
+	return llm.ProviderOptions{
+		SystemPrompt: workflow.SystemPrompt,
+		Timeout:      viper.GetDuration("llm_timeout"),
+		Retry: llm.RetryPolicy{
+			MaxRetries:     viper.GetInt("llm_max_retries"),
+			InitialBackoff: viper.GetDuration("llm_retry_initial_backoff"),
+			MaxBackoff:     viper.GetDuration("llm_retry_max_backoff"),
+		},
+		JSONRepairs: viper.GetInt("json_max_repairs"),
+	}
+}
@@ -0,0 +1,178 @@
+package executor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+
+	"github.com/remijnoel/ailops/redact"
+)
+
+// capture keeps the first HeadBytes and the last TailBytes of an output, so that the memory
+// used by a command does not depend on the size of its output. Once the output no longer
+// fits, it is written in full to the spill file, when there is one. With a redactor, the
+// output is redacted before it is kept or spilled, see Writer.
+type capture struct {
+	redacted  *redact.Writer // Writer of the command when the output is redacted
+	limits    Limits
+	head      []byte
+	tail      []byte // Ring buffer of the last TailBytes, the oldest byte at start once full
+	start     int
+	total     int64
+	spillPath string // Created on the first byte that does not fit, none when empty
+	spill     *os.File
+	spillErr  error
+}
+
+func newCapture(limits Limits, spillPath string, redactor *redact.Redactor) *capture {
+	c := &capture{limits: limits, spillPath: spillPath}
+	if redactor != nil {
+		c.redacted = redactor.NewWriter(c)
+	}
+	return c
+}
+
+// Writer returns the writer receiving the output of the command
+func (c *capture) Writer() io.Writer {
+	if c.redacted != nil {
+		return c.redacted
+	}
+	return c
+}
+
+// flush writes the end of the output held by the redaction, once the command is done
+func (c *capture) flush() {
+	if c.redacted != nil {
+		c.redacted.Close()
+	}
+}
+
+func (c *capture) Write(p []byte) (int, error) {
+	if c.spill == nil && c.spillErr == nil && c.spillPath != "" && c.total+int64(len(p)) > c.limits.max() {
+		c.openSpill()
+	}
+	if c.spill != nil {
+		if _, err := c.spill.Write(p); err != nil {
+			c.spillErr = err
+			c.spill.Close()
+			c.spill = nil
+		}
+	}
+	c.total += int64(len(p))
+
+	n := min(c.limits.HeadBytes-len(c.head), len(p))
+	c.head = append(c.head, p[:n]...)
+	c.writeTail(p[n:])
+	return len(p), nil
+}
+
+// openSpill creates the spill file, starting with the output captured so far, which is
+// still complete
+func (c *capture) openSpill() {
+	if err := os.MkdirAll(filepath.Dir(c.spillPath), 0700); err != nil {
+		c.spillErr = err
+		return
+	}
+	// Keep the outputs private even though they are redacted, the redaction is best-effort
+	f, err := os.OpenFile(c.spillPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		c.spillErr = err
+		return
+	}
+	if _, err := f.Write(append(append([]byte{}, c.head...), c.tailBytes()...)); err != nil {
+		f.Close()
+		c.spillErr = err
+		return
+	}
+	c.spill = f
+}
+
+func (c *capture) writeTail(p []byte) {
+	size := c.limits.TailBytes
+	if size <= 0 || len(p) == 0 {
+		return
+	}
+	if len(p) >= size {
+		c.tail = append(c.tail[:0], p[len(p)-size:]...)
+		c.start = 0
+		return
+	}
+	for len(p) > 0 {
+		if len(c.tail) < size {
+			n := min(size-len(c.tail), len(p))
+			c.tail = append(c.tail, p[:n]...)
+			p = p[n:]
+			continue
+		}
+		n := copy(c.tail[c.start:], p)
+		p = p[n:]
+		c.start = (c.start + n) % size
+	}
+}
+
+func (c *capture) tailBytes() []byte {
+	return append(append([]byte{}, c.tail[c.start:]...), c.tail[:c.start]...)
+}
+
+// Truncated tells whether a part of the output was dropped
+func (c *capture) Truncated() bool {
+	return c.total > c.limits.max()
+}
+
+// String returns the captured output, with a marker in place of the dropped middle
+func (c *capture) String() string {
+	if !c.Truncated() {
+		return string(c.head) + string(c.tailBytes())
+	}
+	head := trimIncompleteRuneEnd(c.head)
+	tail := trimIncompleteRuneStart(c.tailBytes())
+	elided := c.total - int64(len(head)) - int64(len(tail))
+	return string(head) + fmt.Sprintf("\n...[%d bytes elided]...\n", elided) + string(tail)
+}
+
+// SpillFile returns the path of the file holding the full output, empty when the output
+// was not truncated or could not be written
+func (c *capture) SpillFile() string {
+	if c.spill == nil {
+		return ""
+	}
+	return c.spillPath
+}
+
+// Close closes the spill file, and returns the first error met while writing it
+func (c *capture) Close() error {
+	if c.spill != nil {
+		if err := c.spill.Close(); err != nil && c.spillErr == nil {
+			c.spillErr = err
+		}
+	}
+	if c.spillErr != nil {
+		return fmt.Errorf("failed to write the full output to %s: %w", c.spillPath, c.spillErr)
+	}
+	return nil
+}
+
+// trimIncompleteRuneEnd drops the bytes of a character cut at the end of b
+func trimIncompleteRuneEnd(b []byte) []byte {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return b[:i]
+			}
+			break
+		}
+	}
+	return b
+}
+
+// trimIncompleteRuneStart drops the bytes of a character cut at the start of b
+func trimIncompleteRuneStart(b []byte) []byte {
+	for i := 0; i < len(b) && i < utf8.UTFMax; i++ {
+		if utf8.RuneStart(b[i]) {
+			return b[i:]
+		}
+	}
+	return b
+}
@@ -0,0 +1,144 @@
+// Package executor runs the commands of a debug session on its target: the local host, a
+// remote host, a container or a pod. Each kind of target is implemented by a backend
+// registered by the scheme of its URI.
+package executor
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/remijnoel/ailops/redact"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DEFAULT_HEAD_BYTES = 1024 // Bytes kept from the start of the standard output and error of a command
+	DEFAULT_TAIL_BYTES = 1024 // Bytes kept from their end
+
+	LOCAL = "local" // Scheme and host name of the local target
+)
+
+// Limits bounds the part of the standard output and error of a command kept in memory
+type Limits struct {
+	HeadBytes int `json:"head_bytes" mapstructure:"head_bytes"` // Bytes kept from the start of each output
+	TailBytes int `json:"tail_bytes" mapstructure:"tail_bytes"` // Bytes kept from the end of each output
+}
+
+func (l Limits) max() int64 {
+	return int64(l.HeadBytes) + int64(l.TailBytes)
+}
+
+// DefaultLimits are used when the options of a command set no limits
+var DefaultLimits = Limits{HeadBytes: DEFAULT_HEAD_BYTES, TailBytes: DEFAULT_TAIL_BYTES}
+
+// Options of a command
+type Options struct {
+	Limits    Limits // DefaultLimits when zero
+	SpillFile string // Path prefix of the files receiving the full outputs when they are truncated, with the .stdout and .stderr extensions, none when empty
+
+	Redactor *redact.Redactor // Redacts the outputs before they are captured and spilled, nil keeps them as they are
+}
+
+// Result is the outcome of a command
+type Result struct {
+	Stdout     string
+	Stderr     string
+	ExitCode   int    // -1 when the command did not exit normally, e.g. killed or not started
+	Truncated  bool   // The middle of Stdout or Stderr was dropped
+	StdoutFile string // Full standard output, when truncated and spilled
+	StderrFile string // Full standard error, when truncated and spilled
+	Err        error  // Set when the command failed or could not be run
+}
+
+// Executor runs commands on a target. Its methods may be called concurrently.
+type Executor interface {
+	Run(ctx context.Context, command string, opts Options) Result
+	Target() string // Normalized target URI, e.g. "ssh://root@web-1:22"
+	Host() string   // Host, container or pod the commands run on, LOCAL for the local host
+	Close() error
+}
+
+// Factory creates the executor of a target URI, validated by ParseTarget
+type Factory func(target *url.URL) (Executor, error)
+
+var (
+	mu        sync.RWMutex
+	factories = map[string]Factory{}
+)
+
+// Register makes the backend of a scheme available to New
+func Register(scheme string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	factories[scheme] = factory
+}
+
+// Schemes returns the registered schemes in alphabetical order
+func Schemes() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	schemes := make([]string, 0, len(factories))
+	for scheme := range factories {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// New returns the executor of a target, see ParseTarget for the supported formats
+func New(target string) (Executor, error) {
+	u, err := ParseTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	mu.RLock()
+	factory, ok := factories[u.Scheme]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("invalid target %q: unsupported scheme %q, supported schemes are %s", target, u.Scheme, strings.Join(Schemes(), ", "))
+	}
+	e, err := factory(u)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target %q: %w", target, err)
+	}
+	return e, nil
+}
+
+// newCaptures returns the writers capturing the standard output and error of a command
+func newCaptures(opts Options) (stdout, stderr *capture) {
+	limits := opts.Limits
+	if limits == (Limits{}) {
+		limits = DefaultLimits
+	}
+	var stdoutFile, stderrFile string
+	if opts.SpillFile != "" {
+		stdoutFile, stderrFile = opts.SpillFile+".stdout", opts.SpillFile+".stderr"
+	}
+	return newCapture(limits, stdoutFile, opts.Redactor), newCapture(limits, stderrFile, opts.Redactor)
+}
+
+// newResult returns the result of a command that wrote to the stdout and stderr captures,
+// and ended with err and the exit code
+func newResult(stdout, stderr *capture, exitCode int, err error) Result {
+	stdout.flush()
+	stderr.flush()
+	r := Result{
+		Stdout:     stdout.String(),
+		Stderr:     stderr.String(),
+		ExitCode:   exitCode,
+		Truncated:  stdout.Truncated() || stderr.Truncated(),
+		StdoutFile: stdout.SpillFile(),
+		StderrFile: stderr.SpillFile(),
+		Err:        err,
+	}
+	for _, c := range []*capture{stdout, stderr} {
+		if err := c.Close(); err != nil {
+			log.Warn(err)
+		}
+	}
+	return r
+}
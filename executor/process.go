@@ -0,0 +1,101 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// WAIT_DELAY bounds the wait for the output once the command is killed, as the processes it
+// started in the background may keep the output open
+const WAIT_DELAY = 2 * time.Second
+
+func init() {
+	Register(LOCAL, newLocalExecutor)
+	Register("docker", newDockerExecutor)
+	Register("k8s", newKubernetesExecutor)
+}
+
+// processExecutor runs the commands with a local program taking the command after -c,
+// e.g. bash locally or a shell in a container through docker exec
+type processExecutor struct {
+	target string
+	host   string
+	args   []string // Program and arguments preceding "-c <command>"
+}
+
+func (e *processExecutor) Run(ctx context.Context, command string, opts Options) Result {
+	args := append(append([]string{}, e.args[1:]...), "-c", command)
+	cmd := exec.CommandContext(ctx, e.args[0], args...)
+	// Kill the children of the shell with it when the command is canceled or times out
+	killProcessGroup(cmd)
+	cmd.WaitDelay = WAIT_DELAY
+	stdout, stderr := newCaptures(opts)
+	cmd.Stdout, cmd.Stderr = stdout.Writer(), stderr.Writer()
+	err := cmd.Run()
+	exitCode := 0
+	if err != nil {
+		exitCode = -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode() // -1 when killed by a signal
+		}
+	}
+	return newResult(stdout, stderr, exitCode, err)
+}
+
+func (e *processExecutor) Target() string { return e.target }
+
+func (e *processExecutor) Host() string { return e.host }
+
+func (e *processExecutor) Close() error { return nil }
+
+// Local returns the executor running the commands on the local host with bash
+func Local() Executor {
+	return &processExecutor{target: LOCAL + "://", host: LOCAL, args: []string{"bash"}}
+}
+
+// newLocalExecutor handles local://
+func newLocalExecutor(target *url.URL) (Executor, error) {
+	if target.Host != "" || target.Path != "" || target.User != nil {
+		return nil, fmt.Errorf("the local target takes no address, use local://")
+	}
+	return Local(), nil
+}
+
+// newDockerExecutor handles docker://container, running the commands with sh in the container
+func newDockerExecutor(target *url.URL) (Executor, error) {
+	container := target.Host
+	if container == "" || target.User != nil || target.Port() != "" || len(pathSegments(target)) > 0 {
+		return nil, fmt.Errorf("expected docker://<container>, with the name or ID of a running container")
+	}
+	return &processExecutor{
+		target: "docker://" + container,
+		host:   container,
+		args:   []string{"docker", "exec", container, "sh"},
+	}, nil
+}
+
+// newKubernetesExecutor handles k8s://namespace/pod and k8s://namespace/pod/container,
+// running the commands with sh in the container through kubectl exec
+func newKubernetesExecutor(target *url.URL) (Executor, error) {
+	namespace := target.Host
+	segments := pathSegments(target)
+	if namespace == "" || target.User != nil || target.Port() != "" || len(segments) < 1 || len(segments) > 2 {
+		return nil, fmt.Errorf("expected k8s://<namespace>/<pod>[/<container>]")
+	}
+	args := []string{"kubectl", "exec", "--namespace", namespace, segments[0]}
+	if len(segments) == 2 {
+		args = append(args, "--container", segments[1])
+	}
+	args = append(args, "--", "sh")
+	return &processExecutor{
+		target: "k8s://" + namespace + "/" + strings.Join(segments, "/"),
+		host:   segments[0],
+		args:   args,
+	}, nil
+}
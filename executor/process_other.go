@@ -0,0 +1,8 @@
+//go:build !unix
+
+package executor
+
+import "os/exec"
+
+// killProcessGroup keeps the default cancellation, which only kills the command
+func killProcessGroup(cmd *exec.Cmd) {}
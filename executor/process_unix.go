@@ -0,0 +1,17 @@
+//go:build unix
+
+package executor
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// killProcessGroup runs the command in a new session, and kills the whole session when the
+// context is done. Without a controlling terminal, sudo fails instead of asking for a password.
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,172 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	DEFAULT_SSH_USER = "root"
+	DEFAULT_SSH_PORT = "22"
+
+	SSH_DIAL_TIMEOUT = 5 * time.Second
+)
+
+func init() {
+	Register("ssh", newSSHExecutor)
+}
+
+// sshExecutor runs the commands over a single SSH connection, opened on the first command
+// and reopened when it breaks
+type sshExecutor struct {
+	user string
+	host string
+	port string
+
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+// newSSHExecutor handles ssh://[user@]host[:port]
+func newSSHExecutor(target *url.URL) (Executor, error) {
+	if target.Hostname() == "" {
+		return nil, fmt.Errorf("expected ssh://[user@]host[:port], the host is missing")
+	}
+	if _, ok := target.User.Password(); ok {
+		return nil, fmt.Errorf("passwords are not supported, the SSH keys of ~/.ssh are used")
+	}
+	if len(pathSegments(target)) > 0 {
+		return nil, fmt.Errorf("expected ssh://[user@]host[:port], without a path")
+	}
+	e := &sshExecutor{user: DEFAULT_SSH_USER, host: target.Hostname(), port: DEFAULT_SSH_PORT}
+	if target.User != nil && target.User.Username() != "" {
+		e.user = target.User.Username()
+	}
+	if target.Port() != "" {
+		e.port = target.Port()
+	}
+	return e, nil
+}
+
+func (e *sshExecutor) Run(ctx context.Context, command string, opts Options) Result {
+	log.Infof("Running on %s@%s: %s", e.user, e.host, command)
+	session, err := e.newSession()
+	if err != nil {
+		return Result{ExitCode: -1, Err: fmt.Errorf("[%s] failed to connect: %w", e.host, err)}
+	}
+	defer session.Close()
+	// Closing the session aborts the running command when the caller gives up, without
+	// breaking the connection shared with the other commands
+	stop := context.AfterFunc(ctx, func() {
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+	})
+	defer stop()
+
+	stdout, stderr := newCaptures(opts)
+	session.Stdout, session.Stderr = stdout.Writer(), stderr.Writer()
+	err = session.Run(command)
+	exitCode := 0
+	if err != nil {
+		exitCode = -1
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) && exitErr.Signal() == "" {
+			exitCode = exitErr.ExitStatus()
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}
+	return newResult(stdout, stderr, exitCode, err)
+}
+
+func (e *sshExecutor) Target() string {
+	return "ssh://" + e.user + "@" + net.JoinHostPort(e.host, e.port)
+}
+
+func (e *sshExecutor) Host() string { return e.host }
+
+func (e *sshExecutor) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.client == nil {
+		return nil
+	}
+	err := e.client.Close()
+	e.client = nil
+	return err
+}
+
+// newSession opens a session on the connection, reconnecting once when it is broken
+func (e *sshExecutor) newSession() (*ssh.Session, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.client != nil {
+		session, err := e.client.NewSession()
+		if err == nil {
+			return session, nil
+		}
+		log.Warnf("SSH connection to %s lost, reconnecting: %v", e.host, err)
+		e.client.Close()
+		e.client = nil
+	}
+
+	config := &ssh.ClientConfig{
+		User:            e.user,
+		Auth:            defaultAuthMethods(),        // Keys of ~/.ssh, like the ssh CLI
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // NOTE: Insecure, use only for testing!
+		Timeout:         SSH_DIAL_TIMEOUT,
+	}
+	log.Infof("Connecting to %s@%s", e.user, e.host)
+	for _, method := range config.Auth {
+		log.Debugf("Available auth method: %T", method)
+	}
+	client, err := ssh.Dial("tcp", net.JoinHostPort(e.host, e.port), config)
+	if err != nil {
+		return nil, err
+	}
+	e.client = client
+	return client.NewSession()
+}
+
+// Helper to skip public key files
+func isPublicKey(file string) bool {
+	return filepath.Ext(file) == ".pub"
+}
+
+// Returns a slice of AuthMethod that mimics "ssh" CLI (all ~/.ssh/id_* keys)
+func defaultAuthMethods() []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+
+	home, err := os.UserHomeDir()
+	if err == nil {
+		files, _ := filepath.Glob(filepath.Join(home, ".ssh", "id_*"))
+
+		for _, file := range files {
+			key, err := os.ReadFile(file)
+			if err != nil || isPublicKey(file) {
+				log.Debugf("Public key found. Skipping file %s: %v", file, err)
+				continue
+			}
+			signer, err := ssh.ParsePrivateKey(key)
+			if err == nil {
+				log.Debugf("Loaded SSH key: %s", file)
+				methods = append(methods, ssh.PublicKeys(signer))
+			} else {
+				log.Warnf("Failed to parse SSH key %s: %v", file, err)
+			}
+		}
+	}
+	log.Debugf("Available SSH auth methods: %v", methods)
+	return methods
+}
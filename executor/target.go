@@ -0,0 +1,64 @@
+package executor
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ParseTarget parses a target URI such as "ssh://user@[::1]:2222", "docker://web",
+// "k8s://namespace/pod/container" or "local://". An empty target is the local host, and
+// a target without a scheme is an SSH one, e.g. "user@host:2222". The validation of the
+// address is left to the backend of the scheme.
+func ParseTarget(target string) (*url.URL, error) {
+	if target == "" {
+		return &url.URL{Scheme: LOCAL}, nil
+	}
+	uri := target
+	if !strings.Contains(uri, "://") {
+		uri = "ssh://" + uri
+	}
+	scheme, rest, _ := strings.Cut(uri, "://")
+	if scheme == "" {
+		return nil, fmt.Errorf("invalid target %q: missing scheme before ://", target)
+	}
+	authority, _, _ := strings.Cut(rest, "/")
+	if strings.Count(authority, "@") > 1 {
+		return nil, fmt.Errorf("invalid target %q: more than one @, expected %s://user@host", target, scheme)
+	}
+	if i := strings.LastIndex(authority, "@"); i >= 0 {
+		authority = authority[i+1:]
+	}
+	if strings.Count(authority, ":") > 1 && !strings.HasPrefix(authority, "[") {
+		return nil, fmt.Errorf("invalid target %q: IPv6 addresses must be enclosed in brackets, e.g. %s://[%s]:22", target, scheme, authority)
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("invalid target %q: %w", target, err)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("invalid target %q: query strings and fragments are not supported", target)
+	}
+	if port := u.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("invalid target %q: port %s is not between 1 and 65535", target, port)
+		}
+	}
+	return u, nil
+}
+
+// pathSegments returns the non-empty segments of the path of a target
+func pathSegments(u *url.URL) []string {
+	var segments []string
+	for _, s := range strings.Split(u.Path, "/") {
+		if s != "" {
+			segments = append(segments, s)
+		}
+	}
+	return segments
+}
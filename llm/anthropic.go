@@ -0,0 +1,445 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ANTHROPIC_DEFAULT_BASE_URL   = "https://api.anthropic.com"
+	ANTHROPIC_API_VERSION        = "2023-06-01"
+	ANTHROPIC_DEFAULT_MAX_TOKENS = 4096
+
+	// Name of the tool used to force structured output
+	structuredOutputTool = "structured_output"
+)
+
+// AnthropicProvider talks to the Anthropic Messages API (or a gateway exposing it)
+type AnthropicProvider struct {
+	httpClient   *http.Client
+	apiKey       string
+	baseURL      string
+	systemPrompt string
+	model        Model
+	maxTokens    int
+	timeout      time.Duration
+	retry        RetryPolicy
+}
+
+type AnthropicProviderConfig struct {
+	APIKey       string
+	SystemPrompt string
+	Model        Model
+	BaseUrl      string        // Optional, defaults to ANTHROPIC_DEFAULT_BASE_URL
+	MaxTokens    int           // Maximum number of output tokens, defaults to ANTHROPIC_DEFAULT_MAX_TOKENS
+	Timeout      time.Duration // Per-request timeout, 0 means no timeout
+	Retry        RetryPolicy   // Retry policy for failed requests
+	HTTPClient   *http.Client  // Optional, defaults to http.DefaultClient
+}
+
+func NewAnthropicProvider(conf AnthropicProviderConfig) *AnthropicProvider {
+	if conf.APIKey == "" {
+		log.Fatal("API key is required for Anthropic provider")
+	}
+	baseURL := conf.BaseUrl
+	if baseURL == "" {
+		baseURL = ANTHROPIC_DEFAULT_BASE_URL
+	}
+	log.Debugf("Setting Anthropic base URL to: %s", baseURL)
+	maxTokens := conf.MaxTokens
+	if maxTokens <= 0 {
+		maxTokens = ANTHROPIC_DEFAULT_MAX_TOKENS
+	}
+	httpClient := conf.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &AnthropicProvider{
+		httpClient:   httpClient,
+		apiKey:       conf.APIKey,
+		baseURL:      baseURL,
+		systemPrompt: conf.SystemPrompt,
+		model:        conf.Model,
+		maxTokens:    maxTokens,
+		timeout:      conf.Timeout,
+		retry:        conf.Retry,
+	}
+}
+
+type anthropicMessage struct {
+	Role    string `json:"role"`
+	Content any    `json:"content"` // A string or a list of anthropicContentBlock
+}
+
+type anthropicTool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	InputSchema map[string]any `json:"input_schema"`
+}
+
+type anthropicToolChoice struct {
+	Type                   string `json:"type"`
+	Name                   string `json:"name,omitempty"`
+	DisableParallelToolUse bool   `json:"disable_parallel_tool_use,omitempty"` // At most one tool call per answer
+}
+
+type anthropicRequest struct {
+	Model       string               `json:"model"`
+	MaxTokens   int                  `json:"max_tokens"`
+	Temperature *float64             `json:"temperature,omitempty"`
+	TopP        *float64             `json:"top_p,omitempty"`
+	System      string               `json:"system,omitempty"`
+	Messages    []anthropicMessage   `json:"messages"`
+	Tools       []anthropicTool      `json:"tools,omitempty"`
+	ToolChoice  *anthropicToolChoice `json:"tool_choice,omitempty"`
+	Stream      bool                 `json:"stream,omitempty"`
+}
+
+type anthropicContentBlock struct {
+	Type         string                 `json:"type"`
+	Text         string                 `json:"text,omitempty"`
+	ID           string                 `json:"id,omitempty"`
+	Name         string                 `json:"name,omitempty"`
+	Input        json.RawMessage        `json:"input,omitempty"`
+	ToolUseID    string                 `json:"tool_use_id,omitempty"`   // For tool_result blocks
+	Content      string                 `json:"content,omitempty"`       // For tool_result blocks
+	CacheControl *anthropicCacheControl `json:"cache_control,omitempty"` // Caches the prompt up to this block
+}
+
+type anthropicCacheControl struct {
+	Type string `json:"type"`
+}
+
+type anthropicUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+}
+
+// promptTokens counts the cached tokens too, input_tokens only covers the uncached part
+func (u anthropicUsage) promptTokens() int {
+	return u.InputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens
+}
+
+type anthropicResponse struct {
+	Content    []anthropicContentBlock `json:"content"`
+	StopReason string                  `json:"stop_reason"`
+	Usage      anthropicUsage          `json:"usage"`
+}
+
+func (p *AnthropicProvider) RequestCompletion(ctx context.Context, prompt string) (string, error) {
+	log.Debugf("Requesting completion from Anthropic with prompt: %s", prompt)
+	return p.Chat(ctx, ChatRequest{Messages: userMessages(prompt)})
+}
+
+// RequestCompletionWithJSONSchema forces the model to call a tool whose input schema is
+// the requested schema, and returns the tool input as raw JSON.
+func (p *AnthropicProvider) RequestCompletionWithJSONSchema(ctx context.Context, prompt string, schema any) (string, error) {
+	res, err := p.Chat(ctx, ChatRequest{Messages: userMessages(prompt), Schema: schema})
+	if err != nil {
+		return "", err
+	}
+	log.Debugf("Anthropic response: %s", res)
+	return res, nil
+}
+
+func (p *AnthropicProvider) Model() Model {
+	return p.model
+}
+
+func (p *AnthropicProvider) StreamCompletion(ctx context.Context, prompt string, onDelta func(string)) (string, error) {
+	log.Debugf("Streaming completion from Anthropic with prompt: %s", prompt)
+	return p.Chat(ctx, ChatRequest{Messages: userMessages(prompt), OnDelta: onDelta})
+}
+
+// StreamCompletionWithJSONSchema streams the input of the forced tool call, which is the JSON answer
+func (p *AnthropicProvider) StreamCompletionWithJSONSchema(ctx context.Context, prompt string, schema any, onDelta func(string)) (string, error) {
+	return p.Chat(ctx, ChatRequest{Messages: userMessages(prompt), Schema: schema, OnDelta: onDelta})
+}
+
+// Chat sends the conversation with a cache breakpoint on its last message, so that the
+// next request of the same conversation reads the earlier turns from the prompt cache
+func (p *AnthropicProvider) Chat(ctx context.Context, chat ChatRequest) (string, error) {
+	req := p.newRequest(ctx, chat.Messages)
+	if chat.Schema != nil {
+		var err error
+		if req, err = withStructuredOutput(req, chat.Schema); err != nil {
+			return "", err
+		}
+	}
+	if chat.OnDelta != nil {
+		return p.streamMessage(ctx, req, chat.OnDelta)
+	}
+
+	resp, err := p.createMessage(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	if chat.Schema != nil {
+		for _, block := range resp.Content {
+			if block.Type == "tool_use" && block.Name == structuredOutputTool {
+				return string(block.Input), nil
+			}
+		}
+		return "", fmt.Errorf("Anthropic response did not contain a %s tool call (stop reason: %s)", structuredOutputTool, resp.StopReason)
+	}
+	var text strings.Builder
+	for _, block := range resp.Content {
+		if block.Type == "text" {
+			text.WriteString(block.Text)
+		}
+	}
+	return text.String(), nil
+}
+
+// newRequest sends the system messages with the system prompt of the provider, and applies
+// the generation parameters supported by the Messages API, which has no seed nor reasoning effort
+func (p *AnthropicProvider) newRequest(ctx context.Context, messages []Message) anthropicRequest {
+	system := []string{}
+	if p.systemPrompt != "" {
+		system = append(system, p.systemPrompt)
+	}
+	var turns []Message
+	for _, m := range messages {
+		if m.Role == ROLE_SYSTEM {
+			system = append(system, m.Content)
+		} else {
+			turns = append(turns, m)
+		}
+	}
+	generation := generationParams(ctx, p.model)
+	req := anthropicRequest{
+		Model:       p.model.Name,
+		MaxTokens:   p.maxTokens,
+		Temperature: generation.Temperature,
+		TopP:        generation.TopP,
+		System:      strings.Join(system, "\n\n"),
+		Messages:    withCacheBreakpoint(anthropicMessages(turns)),
+	}
+	if generation.MaxTokens != nil {
+		req.MaxTokens = *generation.MaxTokens
+	}
+	return req
+}
+
+func withStructuredOutput(req anthropicRequest, schema any) (anthropicRequest, error) {
+	inputSchema, err := schemaToMap(schema)
+	if err != nil {
+		return anthropicRequest{}, err
+	}
+
+	req.Tools = []anthropicTool{{
+		Name:        structuredOutputTool,
+		Description: "Record the answer using this exact structure.",
+		InputSchema: inputSchema,
+	}}
+	req.ToolChoice = &anthropicToolChoice{Type: "tool", Name: structuredOutputTool}
+	return req, nil
+}
+
+func (p *AnthropicProvider) headers() map[string]string {
+	return map[string]string{
+		"x-api-key":         p.apiKey,
+		"anthropic-version": ANTHROPIC_API_VERSION,
+	}
+}
+
+// createMessage sends the request with the provider timeout and retry policy
+func (p *AnthropicProvider) createMessage(ctx context.Context, req anthropicRequest) (*anthropicResponse, error) {
+	url := p.messagesURL()
+	resp, err := withRetry(ctx, p.retry, p.timeout, func(ctx context.Context) (*anthropicResponse, error) {
+		var resp anthropicResponse
+		if err := postJSON(ctx, p.httpClient, url, p.headers(), req, &resp); err != nil {
+			return nil, err
+		}
+		return &resp, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	recordCall(ctx, Call{
+		Model: p.model.Name,
+		Usage: Usage{PromptTokens: resp.Usage.promptTokens(), CompletionTokens: resp.Usage.OutputTokens},
+	})
+	return resp, nil
+}
+
+// messagesURL accepts base URLs with or without the /v1 suffix
+func (p *AnthropicProvider) messagesURL() string {
+	base := strings.TrimRight(p.baseURL, "/")
+	if strings.HasSuffix(base, "/v1") {
+		return joinURL(base, "messages")
+	}
+	return joinURL(base, "v1/messages")
+}
+
+type anthropicStreamEvent struct {
+	Type    string `json:"type"`
+	Message struct {
+		Usage anthropicUsage `json:"usage"`
+	} `json:"message"`
+	Delta struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+	} `json:"delta"`
+	Usage struct {
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// streamMessage streams the text, or the tool input for structured requests, to onDelta
+func (p *AnthropicProvider) streamMessage(ctx context.Context, req anthropicRequest, onDelta func(string)) (string, error) {
+	req.Stream = true
+	url := p.messagesURL()
+	tracker := &deltaTracker{onDelta: onDelta}
+	var usage Usage
+
+	_, err := withRetry(ctx, p.retry, p.timeout, func(ctx context.Context) (struct{}, error) {
+		resp, err := doJSON(ctx, p.httpClient, http.MethodPost, url, p.headers(), req)
+		if err != nil {
+			return struct{}{}, err
+		}
+		defer resp.Body.Close()
+
+		var streamErr error
+		err = readSSE(resp.Body, func(_ string, data string) bool {
+			var event anthropicStreamEvent
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				streamErr = fmt.Errorf("invalid Anthropic stream event: %w", err)
+				return false
+			}
+			switch event.Type {
+			case "message_start":
+				usage.PromptTokens = event.Message.Usage.promptTokens()
+			case "content_block_delta":
+				if event.Delta.Type == "text_delta" {
+					tracker.emit(event.Delta.Text)
+				} else if event.Delta.Type == "input_json_delta" {
+					tracker.emit(event.Delta.PartialJSON)
+				}
+			case "message_delta":
+				usage.CompletionTokens = event.Usage.OutputTokens
+			case "error":
+				// Overloaded errors are sent in the stream with a 200 status
+				status := http.StatusInternalServerError
+				if event.Error.Type == "overloaded_error" {
+					status = 529
+				}
+				streamErr = &APIError{StatusCode: status, Body: event.Error.Message}
+				return false
+			case "message_stop":
+				return false
+			}
+			return true
+		})
+		if err == nil {
+			err = streamErr
+		}
+		if err != nil {
+			return struct{}{}, tracker.fail(err)
+		}
+		return struct{}{}, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	recordCall(ctx, Call{Model: p.model.Name, Usage: usage})
+	return tracker.text.String(), nil
+}
+
+// RequestToolCalls uses the Anthropic tool use, one call at a time. Tool results are sent
+// back as user messages.
+func (p *AnthropicProvider) RequestToolCalls(ctx context.Context, messages []Message, tools []Tool) (Message, error) {
+	req := p.newRequest(ctx, messages)
+	req.ToolChoice = &anthropicToolChoice{Type: "auto", DisableParallelToolUse: true}
+	for _, tool := range tools {
+		inputSchema, err := schemaToMap(tool.Parameters)
+		if err != nil {
+			return Message{}, err
+		}
+		req.Tools = append(req.Tools, anthropicTool{Name: tool.Name, Description: tool.Description, InputSchema: inputSchema})
+	}
+
+	resp, err := p.createMessage(ctx, req)
+	if err != nil {
+		return Message{}, err
+	}
+	answer := Message{Role: ROLE_ASSISTANT}
+	for _, block := range resp.Content {
+		switch block.Type {
+		case "text":
+			answer.Content += block.Text
+		case "tool_use":
+			answer.ToolCalls = append(answer.ToolCalls, ToolCall{ID: block.ID, Name: block.Name, Arguments: string(block.Input)})
+		}
+	}
+	return answer, nil
+}
+
+// anthropicMessages converts the conversation, grouping consecutive tool results in one user message
+func anthropicMessages(messages []Message) []anthropicMessage {
+	var res []anthropicMessage
+	for _, m := range messages {
+		switch m.Role {
+		case ROLE_ASSISTANT:
+			var blocks []anthropicContentBlock
+			if m.Content != "" {
+				blocks = append(blocks, anthropicContentBlock{Type: "text", Text: m.Content})
+			}
+			for _, call := range m.ToolCalls {
+				input := json.RawMessage(call.Arguments)
+				if len(input) == 0 {
+					input = json.RawMessage("{}")
+				}
+				blocks = append(blocks, anthropicContentBlock{Type: "tool_use", ID: call.ID, Name: call.Name, Input: input})
+			}
+			res = append(res, anthropicMessage{Role: "assistant", Content: blocks})
+		case ROLE_TOOL:
+			block := anthropicContentBlock{Type: "tool_result", ToolUseID: m.ToolCallID, Content: m.Content}
+			if last := len(res) - 1; last >= 0 && res[last].Role == "user" {
+				if blocks, ok := res[last].Content.([]anthropicContentBlock); ok {
+					res[last].Content = append(blocks, block)
+					continue
+				}
+			}
+			res = append(res, anthropicMessage{Role: "user", Content: []anthropicContentBlock{block}})
+		default:
+			res = append(res, anthropicMessage{Role: "user", Content: m.Content})
+		}
+	}
+	return res
+}
+
+// withCacheBreakpoint marks the last block of the conversation for prompt caching
+func withCacheBreakpoint(messages []anthropicMessage) []anthropicMessage {
+	if len(messages) == 0 {
+		return messages
+	}
+	last := &messages[len(messages)-1]
+	var blocks []anthropicContentBlock
+	switch content := last.Content.(type) {
+	case string:
+		blocks = []anthropicContentBlock{{Type: "text", Text: content}}
+	case []anthropicContentBlock:
+		blocks = append([]anthropicContentBlock(nil), content...)
+	}
+	if len(blocks) == 0 {
+		return messages
+	}
+	blocks[len(blocks)-1].CacheControl = &anthropicCacheControl{Type: "ephemeral"}
+	last.Content = blocks
+	return messages
+}
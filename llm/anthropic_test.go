@@ -0,0 +1,108 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func newTestAnthropicProvider(baseURL string) *AnthropicProvider {
+	return NewAnthropicProvider(AnthropicProviderConfig{
+		APIKey:       "test-key",
+		SystemPrompt: "You are a test.",
+		Model:        Model{Name: "claude-test"},
+		BaseUrl:      baseURL,
+	})
+}
+
+func TestAnthropicRequestCompletion(t *testing.T) {
+	server, requests := newTestServer(t, map[string]string{
+		"/v1/messages": `{
+			"content": [{"type": "text", "text": "The disk "}, {"type": "text", "text": "is full."}],
+			"stop_reason": "end_turn",
+			"usage": {"input_tokens": 10, "output_tokens": 5, "cache_read_input_tokens": 20}
+		}`,
+	})
+	recorder := &CallRecorder{}
+	ctx := WithCallRecorder(context.Background(), recorder)
+
+	answer, err := newTestAnthropicProvider(server.URL).RequestCompletion(ctx, "Why is the host slow?")
+	if err != nil {
+		t.Fatalf("RequestCompletion failed: %v", err)
+	}
+	if answer != "The disk is full." {
+		t.Errorf("answer %q, want %q", answer, "The disk is full.")
+	}
+
+	req := lastRequest(t, requests)
+	if req.Header.Get("x-api-key") != "test-key" || req.Header.Get("anthropic-version") != ANTHROPIC_API_VERSION {
+		t.Errorf("unexpected headers %v", req.Header)
+	}
+	if got := field(req.Body, "model"); got != "claude-test" {
+		t.Errorf("model %v, want claude-test", got)
+	}
+	if got := field(req.Body, "system"); got != "You are a test." {
+		t.Errorf("system %v, want the system prompt", got)
+	}
+	if got := field(req.Body, "max_tokens"); got != float64(ANTHROPIC_DEFAULT_MAX_TOKENS) {
+		t.Errorf("max_tokens %v, want %d", got, ANTHROPIC_DEFAULT_MAX_TOKENS)
+	}
+	if got := field(req.Body, "tool_choice"); got != nil {
+		t.Errorf("tool_choice %v, want none", got)
+	}
+	checkCall(t, recorder, Call{Model: "claude-test", Usage: Usage{PromptTokens: 30, CompletionTokens: 5}})
+}
+
+func TestAnthropicRequestCompletionWithJSONSchema(t *testing.T) {
+	server, requests := newTestServer(t, map[string]string{
+		"/v1/messages": `{
+			"content": [
+				{"type": "text", "text": "Here is the answer."},
+				{"type": "tool_use", "id": "toolu_1", "name": "structured_output", "input": {"verdict": "safe"}}
+			],
+			"stop_reason": "tool_use",
+			"usage": {"input_tokens": 12, "output_tokens": 7}
+		}`,
+	})
+	recorder := &CallRecorder{}
+	ctx := WithCallRecorder(context.Background(), recorder)
+
+	answer, err := newTestAnthropicProvider(server.URL+"/v1").RequestCompletionWithJSONSchema(ctx, "Is ls safe?", GenerateSchema[testAnswer]())
+	if err != nil {
+		t.Fatalf("RequestCompletionWithJSONSchema failed: %v", err)
+	}
+	var parsed testAnswer
+	if err := json.Unmarshal([]byte(answer), &parsed); err != nil || parsed.Verdict != "safe" {
+		t.Errorf("answer %q, want the input of the tool call", answer)
+	}
+
+	req := lastRequest(t, requests)
+	if req.Path != "/v1/messages" {
+		t.Errorf("path %s, want /v1/messages", req.Path)
+	}
+	if got := field(req.Body, "tool_choice", "type"); got != "tool" {
+		t.Errorf("tool_choice type %v, want tool", got)
+	}
+	if got := field(req.Body, "tool_choice", "name"); got != structuredOutputTool {
+		t.Errorf("tool_choice name %v, want %s", got, structuredOutputTool)
+	}
+	tools, _ := field(req.Body, "tools").([]any)
+	if len(tools) != 1 || field(tools[0], "name") != structuredOutputTool {
+		t.Fatalf("tools %v, want the %s tool only", tools, structuredOutputTool)
+	}
+	if got := field(tools[0], "input_schema", "properties", "verdict", "type"); got != "string" {
+		t.Errorf("input_schema %v, want the requested schema", field(tools[0], "input_schema"))
+	}
+	checkCall(t, recorder, Call{Model: "claude-test", Usage: Usage{PromptTokens: 12, CompletionTokens: 7}})
+}
+
+func TestAnthropicRequestCompletionWithJSONSchemaWithoutToolCall(t *testing.T) {
+	server, _ := newTestServer(t, map[string]string{
+		"/v1/messages": `{"content": [{"type": "text", "text": "I cannot answer."}], "stop_reason": "max_tokens"}`,
+	})
+
+	_, err := newTestAnthropicProvider(server.URL).RequestCompletionWithJSONSchema(context.Background(), "Is ls safe?", GenerateSchema[testAnswer]())
+	if err == nil {
+		t.Fatal("RequestCompletionWithJSONSchema succeeded without a tool call")
+	}
+}
@@ -0,0 +1,330 @@
+package llm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DEFAULT_REPLAY_SIMILARITY is the minimum similarity for a recorded prompt to be
+// replayed when no recorded prompt matches exactly
+const DEFAULT_REPLAY_SIMILARITY = 0.8
+
+// Interaction is a request recorded in a cassette
+type Interaction struct {
+	Key      string          `json:"key"`              // Hash of the prompt and schema
+	Model    string          `json:"model"`            // Model that answered
+	Prompt   string          `json:"prompt"`           // Prompt sent to the model
+	Schema   json.RawMessage `json:"schema,omitempty"` // JSON schema of the answer, for structured requests
+	Response string          `json:"response"`         // Answer of the model
+	Usage    Usage           `json:"usage"`            // Tokens consumed by the request
+}
+
+// Cassette is a file of recorded interactions, written by the RecordingProvider and
+// served by the ReplayProvider
+type Cassette struct {
+	mu           sync.Mutex
+	path         string
+	Interactions []*Interaction `json:"interactions"`
+}
+
+// NewCassette returns an empty cassette saved to path
+func NewCassette(path string) *Cassette {
+	return &Cassette{path: path}
+}
+
+// LoadCassette reads a cassette written by a RecordingProvider
+func LoadCassette(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cassette: %w", err)
+	}
+	c := &Cassette{path: path}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("invalid cassette %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// add appends the interaction and saves the cassette, so that an interrupted run keeps
+// what was recorded so far
+func (c *Cassette) add(i *Interaction) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Interactions = append(c.Interactions, i)
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode cassette: %w", err)
+	}
+	// The prompts hold the command outputs of the host, keep them private
+	if err := os.WriteFile(c.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write cassette: %w", err)
+	}
+	return nil
+}
+
+// interactionKey identifies a request by its prompt and schema
+func interactionKey(prompt string, schema json.RawMessage) string {
+	h := sha256.New()
+	h.Write([]byte(prompt))
+	h.Write([]byte{0})
+	h.Write(schema)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func encodeSchema(schema any) (json.RawMessage, error) {
+	if schema == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(schema)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode JSON schema: %w", err)
+	}
+	return data, nil
+}
+
+// RecordingProvider forwards the requests to another provider and records them in a cassette
+type RecordingProvider struct {
+	provider Provider
+	cassette *Cassette
+}
+
+func NewRecordingProvider(provider Provider, cassette *Cassette) *RecordingProvider {
+	return &RecordingProvider{provider: provider, cassette: cassette}
+}
+
+func (p *RecordingProvider) RequestCompletion(ctx context.Context, prompt string) (string, error) {
+	return p.record(ctx, prompt, nil, func(ctx context.Context) (string, error) {
+		return p.provider.RequestCompletion(ctx, prompt)
+	})
+}
+
+func (p *RecordingProvider) RequestCompletionWithJSONSchema(ctx context.Context, prompt string, schema any) (string, error) {
+	return p.record(ctx, prompt, schema, func(ctx context.Context) (string, error) {
+		return p.provider.RequestCompletionWithJSONSchema(ctx, prompt, schema)
+	})
+}
+
+func (p *RecordingProvider) StreamCompletion(ctx context.Context, prompt string, onDelta func(string)) (string, error) {
+	return p.record(ctx, prompt, nil, func(ctx context.Context) (string, error) {
+		return StreamCompletion(ctx, p.provider, prompt, onDelta)
+	})
+}
+
+func (p *RecordingProvider) StreamCompletionWithJSONSchema(ctx context.Context, prompt string, schema any, onDelta func(string)) (string, error) {
+	return p.record(ctx, prompt, schema, func(ctx context.Context) (string, error) {
+		return StreamCompletionWithJSONSchema(ctx, p.provider, prompt, schema, onDelta)
+	})
+}
+
+// Chat records the flattened conversation as the prompt, so that a conversation of a
+// single user turn matches a recorded completion of the same prompt
+func (p *RecordingProvider) Chat(ctx context.Context, req ChatRequest) (string, error) {
+	return p.record(ctx, FlattenMessages(req.Messages), req.Schema, func(ctx context.Context) (string, error) {
+		return Chat(ctx, p.provider, req)
+	})
+}
+
+// RequestToolCalls records the conversation as the prompt and the tools as the schema,
+// both encoded in JSON
+func (p *RecordingProvider) RequestToolCalls(ctx context.Context, messages []Message, tools []Tool) (Message, error) {
+	prompt, err := json.Marshal(messages)
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to encode messages: %w", err)
+	}
+	var answer Message
+	_, err = p.record(ctx, string(prompt), tools, func(ctx context.Context) (string, error) {
+		var err error
+		answer, err = RequestToolCalls(ctx, p.provider, messages, tools)
+		if err != nil {
+			return "", err
+		}
+		encoded, err := json.Marshal(answer)
+		return string(encoded), err
+	})
+	return answer, err
+}
+
+func (p *RecordingProvider) Model() Model {
+	return p.provider.Model()
+}
+
+// record runs fn with its own call recorder to capture the usage of the request, then
+// reports the calls to the caller recorder as if the wrapped provider was used directly
+func (p *RecordingProvider) record(ctx context.Context, prompt string, schema any, fn func(ctx context.Context) (string, error)) (string, error) {
+	encodedSchema, err := encodeSchema(schema)
+	if err != nil {
+		return "", err
+	}
+
+	recorder := &CallRecorder{}
+	res, err := fn(WithCallRecorder(ctx, recorder))
+	calls := recorder.Calls()
+	for _, call := range calls {
+		recordCall(ctx, call)
+	}
+	for _, f := range recorder.Failovers() {
+		recordFailover(ctx, f)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	interaction := &Interaction{
+		Key:      interactionKey(prompt, encodedSchema),
+		Model:    p.provider.Model().Name,
+		Prompt:   prompt,
+		Schema:   encodedSchema,
+		Response: res,
+	}
+	for _, call := range calls {
+		interaction.Model = call.Model
+		interaction.Usage.PromptTokens += call.Usage.PromptTokens
+		interaction.Usage.CompletionTokens += call.Usage.CompletionTokens
+	}
+	if err := p.cassette.add(interaction); err != nil {
+		// The answer is still useful to the caller
+		log.Errorf("Failed to record LLM response: %v", err)
+	}
+	return res, nil
+}
+
+// ReplayProvider answers with the responses recorded in a cassette, without calling any API
+type ReplayProvider struct {
+	mu         sync.Mutex
+	cassette   *Cassette
+	model      Model
+	similarity float64      // Minimum similarity of a fuzzy match, 0 disables fuzzy matching
+	used       map[int]bool // Interactions already replayed
+}
+
+// NewReplayProvider returns a provider replaying the cassette. When no recorded prompt
+// matches exactly, the most similar unused prompt with the same schema is replayed if
+// its similarity is at least similarity (between 0 and 1).
+func NewReplayProvider(cassette *Cassette, model Model, similarity float64) *ReplayProvider {
+	return &ReplayProvider{
+		cassette:   cassette,
+		model:      model,
+		similarity: similarity,
+		used:       map[int]bool{},
+	}
+}
+
+func (p *ReplayProvider) RequestCompletion(ctx context.Context, prompt string) (string, error) {
+	return p.replay(ctx, prompt, nil)
+}
+
+func (p *ReplayProvider) RequestCompletionWithJSONSchema(ctx context.Context, prompt string, schema any) (string, error) {
+	return p.replay(ctx, prompt, schema)
+}
+
+func (p *ReplayProvider) RequestToolCalls(ctx context.Context, messages []Message, tools []Tool) (Message, error) {
+	prompt, err := json.Marshal(messages)
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to encode messages: %w", err)
+	}
+	res, err := p.replay(ctx, string(prompt), tools)
+	if err != nil {
+		return Message{}, err
+	}
+	var answer Message
+	if err := json.Unmarshal([]byte(res), &answer); err != nil {
+		return Message{}, fmt.Errorf("invalid recorded tool calls: %w", err)
+	}
+	return answer, nil
+}
+
+func (p *ReplayProvider) Model() Model {
+	return p.model
+}
+
+func (p *ReplayProvider) replay(ctx context.Context, prompt string, schema any) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	encodedSchema, err := encodeSchema(schema)
+	if err != nil {
+		return "", err
+	}
+
+	interaction, err := p.match(prompt, encodedSchema)
+	if err != nil {
+		return "", err
+	}
+	recordCall(ctx, Call{Model: interaction.Model, Usage: interaction.Usage})
+	return interaction.Response, nil
+}
+
+// match returns the recorded interaction for the request, preferring the ones not replayed
+// yet so that identical prompts get their answers in the recorded order
+func (p *ReplayProvider) match(prompt string, schema json.RawMessage) (*Interaction, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := interactionKey(prompt, schema)
+	exact := -1
+	for i, interaction := range p.cassette.Interactions {
+		if interaction.Key != key {
+			continue
+		}
+		if !p.used[i] {
+			exact = i
+			break
+		}
+		if exact < 0 {
+			exact = i
+		}
+	}
+	if exact >= 0 {
+		p.used[exact] = true
+		return p.cassette.Interactions[exact], nil
+	}
+
+	best, bestScore := -1, 0.0
+	if p.similarity > 0 {
+		words := wordSet(prompt)
+		for i, interaction := range p.cassette.Interactions {
+			if p.used[i] || string(interaction.Schema) != string(schema) {
+				continue
+			}
+			if score := similarity(words, wordSet(interaction.Prompt)); score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+	}
+	if best < 0 || bestScore < p.similarity {
+		return nil, fmt.Errorf("no recorded response in %s matches the prompt (best similarity %.2f)", p.cassette.path, bestScore)
+	}
+	log.Warnf("No recorded prompt matches exactly, replaying the closest one (similarity %.2f)", bestScore)
+	p.used[best] = true
+	return p.cassette.Interactions[best], nil
+}
+
+func wordSet(s string) map[string]bool {
+	words := map[string]bool{}
+	for _, w := range strings.Fields(s) {
+		words[w] = true
+	}
+	return words
+}
+
+// similarity is the Jaccard index of two sets of words
+func similarity(a map[string]bool, b map[string]bool) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 1
+	}
+	common := 0
+	for w := range a {
+		if b[w] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(a)+len(b)-common)
+}
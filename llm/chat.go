@@ -0,0 +1,77 @@
+package llm
+
+import (
+	"context"
+	"strings"
+)
+
+const (
+	ROLE_SYSTEM    = "system"
+	ROLE_USER      = "user"
+	ROLE_ASSISTANT = "assistant"
+	ROLE_TOOL      = "tool"
+)
+
+// Message is a turn of a conversation. Assistant messages may request tool calls, which
+// are answered by tool messages carrying the ID of the call in ToolCallID.
+type Message struct {
+	Role       string     `json:"role"`
+	Content    string     `json:"content"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+}
+
+// ChatRequest is a conversation sent to a ChatProvider
+type ChatRequest struct {
+	Messages []Message    // System, user and assistant turns, oldest first
+	Schema   any          // JSON schema of the answer, nil for a text answer
+	OnDelta  func(string) // Optional, streams the answer when set
+}
+
+// ChatProvider is implemented by providers accepting a message history. Keeping the
+// earlier turns unchanged between requests lets the APIs reuse their cached prefix.
+// The system prompt of the provider is sent before the messages.
+type ChatProvider interface {
+	Provider
+	Chat(ctx context.Context, req ChatRequest) (string, error)
+}
+
+// Chat sends the conversation to the provider. Providers without a message history
+// receive the turns flattened into a single prompt.
+func Chat(ctx context.Context, p Provider, req ChatRequest) (string, error) {
+	if cp, ok := p.(ChatProvider); ok {
+		return cp.Chat(ctx, req)
+	}
+	prompt := FlattenMessages(req.Messages)
+	switch {
+	case req.Schema != nil && req.OnDelta != nil:
+		return StreamCompletionWithJSONSchema(ctx, p, prompt, req.Schema, req.OnDelta)
+	case req.Schema != nil:
+		return p.RequestCompletionWithJSONSchema(ctx, prompt, req.Schema)
+	case req.OnDelta != nil:
+		return StreamCompletion(ctx, p, prompt, req.OnDelta)
+	default:
+		return p.RequestCompletion(ctx, prompt)
+	}
+}
+
+// FlattenMessages renders a conversation as a single prompt
+func FlattenMessages(messages []Message) string {
+	if len(messages) == 1 && messages[0].Role == ROLE_USER {
+		return messages[0].Content
+	}
+	var b strings.Builder
+	for i, m := range messages {
+		if i > 0 {
+			b.WriteString("\n\n")
+		}
+		b.WriteString(strings.ToUpper(m.Role) + ":\n")
+		b.WriteString(m.Content)
+	}
+	return b.String()
+}
+
+// userMessages wraps a prompt into a conversation of one user turn
+func userMessages(prompt string) []Message {
+	return []Message{{Role: ROLE_USER, Content: prompt}}
+}
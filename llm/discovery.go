@@ -0,0 +1,46 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// modelResolver holds the model used by a provider, discovering it from the backend
+// on first use when the configuration does not name one
+type modelResolver struct {
+	mu    sync.Mutex
+	model Model
+}
+
+func (r *modelResolver) resolve(ctx context.Context, lister ModelLister) (Model, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.model.Name != "" {
+		return r.model, nil
+	}
+
+	models, err := lister.ListModels(ctx)
+	if err != nil {
+		return Model{}, fmt.Errorf("failed to discover models: %w", err)
+	}
+	if len(models) == 0 {
+		return Model{}, fmt.Errorf("no model configured and the server does not serve any model")
+	}
+	configured := r.model
+	r.model = models[0]
+	r.model.Options = configured.Options // Configured generation parameters apply to the discovered model
+	if configured.ContextSize > 0 {
+		r.model.ContextSize = configured.ContextSize // So does the configured context size
+	}
+	log.Infof("No model configured, using discovered model %s", r.model.Name)
+	return r.model, nil
+}
+
+func (r *modelResolver) current() Model {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.model
+}
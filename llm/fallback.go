@@ -0,0 +1,108 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// NamedProvider is a provider of a FallbackProvider chain
+type NamedProvider struct {
+	Name     string
+	Provider Provider
+}
+
+// FallbackProvider sends each request to the first provider of the chain, and to the
+// next one when it fails (after its own retries). The calls recorded with
+// WithCallRecorder tell which provider answered, and the failed ones are recorded as
+// failovers.
+type FallbackProvider struct {
+	providers []NamedProvider
+}
+
+func NewFallbackProvider(providers ...NamedProvider) *FallbackProvider {
+	if len(providers) == 0 {
+		log.Fatal("At least one provider is required for the fallback provider")
+	}
+	return &FallbackProvider{providers: providers}
+}
+
+func (p *FallbackProvider) RequestCompletion(ctx context.Context, prompt string) (string, error) {
+	return p.try(ctx, func(ctx context.Context, provider Provider) (string, error) {
+		return provider.RequestCompletion(ctx, prompt)
+	})
+}
+
+func (p *FallbackProvider) RequestCompletionWithJSONSchema(ctx context.Context, prompt string, schema any) (string, error) {
+	return p.try(ctx, func(ctx context.Context, provider Provider) (string, error) {
+		return provider.RequestCompletionWithJSONSchema(ctx, prompt, schema)
+	})
+}
+
+func (p *FallbackProvider) StreamCompletion(ctx context.Context, prompt string, onDelta func(string)) (string, error) {
+	return p.try(ctx, func(ctx context.Context, provider Provider) (string, error) {
+		return StreamCompletion(ctx, provider, prompt, onDelta)
+	})
+}
+
+func (p *FallbackProvider) StreamCompletionWithJSONSchema(ctx context.Context, prompt string, schema any, onDelta func(string)) (string, error) {
+	return p.try(ctx, func(ctx context.Context, provider Provider) (string, error) {
+		return StreamCompletionWithJSONSchema(ctx, provider, prompt, schema, onDelta)
+	})
+}
+
+func (p *FallbackProvider) Chat(ctx context.Context, req ChatRequest) (string, error) {
+	return p.try(ctx, func(ctx context.Context, provider Provider) (string, error) {
+		return Chat(ctx, provider, req)
+	})
+}
+
+func (p *FallbackProvider) RequestToolCalls(ctx context.Context, messages []Message, tools []Tool) (Message, error) {
+	var answer Message
+	_, err := p.try(ctx, func(ctx context.Context, provider Provider) (string, error) {
+		var err error
+		answer, err = RequestToolCalls(ctx, provider, messages, tools)
+		return "", err
+	})
+	return answer, err
+}
+
+// Model returns the model of the first provider, which is the one expected to answer
+func (p *FallbackProvider) Model() Model {
+	return p.providers[0].Provider.Model()
+}
+
+func (p *FallbackProvider) try(ctx context.Context, fn func(ctx context.Context, provider Provider) (string, error)) (string, error) {
+	var lastErr error
+	var failed []string
+	for i, np := range p.providers {
+		recorder := &CallRecorder{}
+		res, err := fn(WithCallRecorder(ctx, recorder), np.Provider)
+		for _, call := range recorder.Calls() {
+			call.Provider = np.Name
+			recordCall(ctx, call)
+		}
+		if err == nil {
+			return res, nil
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+
+		recordFailover(ctx, Failover{Provider: np.Name, Err: err})
+		lastErr = err
+		failed = append(failed, fmt.Sprintf("%s: %v", np.Name, err))
+		var interrupted *streamInterruptedError
+		if errors.As(err, &interrupted) {
+			// Part of the answer was already streamed, another provider would repeat it
+			break
+		}
+		if i+1 < len(p.providers) {
+			log.Warnf("Provider %s failed: %v, falling back to %s", np.Name, err, p.providers[i+1].Name)
+		}
+	}
+	return "", fmt.Errorf("all providers failed (%s): %w", strings.Join(failed, "; "), lastErr)
+}
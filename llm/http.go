@@ -0,0 +1,110 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// APIError is returned by the HTTP based providers when the API answers with an error status
+type APIError struct {
+	StatusCode int
+	Body       string
+	Header     http.Header
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API returned %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), strings.TrimSpace(e.Body))
+}
+
+// postJSON sends body as JSON to url and decodes the JSON response into out
+func postJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, body any, out any) error {
+	resp, err := doJSON(ctx, client, http.MethodPost, url, headers, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response from %s: %w", url, err)
+	}
+	return nil
+}
+
+// getJSON fetches url and decodes the JSON response into out
+func getJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, out any) error {
+	resp, err := doJSON(ctx, client, http.MethodGet, url, headers, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response from %s: %w", url, err)
+	}
+	return nil
+}
+
+// doJSON sends the request and returns the response when the status is 2xx.
+// The caller must close the response body.
+func doJSON(ctx context.Context, client *http.Client, method string, url string, headers map[string]string, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode request: %w", err)
+		}
+		log.Debugf("%s %s: %s", method, url, payload)
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		return nil, &APIError{StatusCode: resp.StatusCode, Body: string(data), Header: resp.Header}
+	}
+	return resp, nil
+}
+
+// schemaToMap converts a schema generated by GenerateSchema into a plain JSON object,
+// dropping the meta keys that some APIs reject
+func schemaToMap(schema any) (map[string]any, error) {
+	data, err := json.Marshal(schema)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode JSON schema: %w", err)
+	}
+	var m map[string]any
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("JSON schema is not an object: %w", err)
+	}
+	delete(m, "$schema")
+	delete(m, "$id")
+	return m, nil
+}
+
+// joinURL appends path to base, avoiding duplicated slashes
+func joinURL(base string, path string) string {
+	return strings.TrimRight(base, "/") + "/" + strings.TrimLeft(path, "/")
+}
@@ -0,0 +1,85 @@
+package llm
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testAnswer is the structured answer requested by the tests
+type testAnswer struct {
+	Verdict string `json:"verdict"`
+}
+
+// recordedRequest is a request received by a test server
+type recordedRequest struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   map[string]any
+}
+
+// newTestServer answers every request with the status and body of the path, and records
+// the requests it receives
+func newTestServer(t *testing.T, responses map[string]string) (*httptest.Server, *[]recordedRequest) {
+	t.Helper()
+	var requests []recordedRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := recordedRequest{Method: r.Method, Path: r.URL.Path, Header: r.Header.Clone()}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed to read the request body: %v", err)
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &req.Body); err != nil {
+				t.Errorf("request body is not a JSON object: %v\n%s", err, data)
+			}
+		}
+		requests = append(requests, req)
+
+		response, ok := responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, response)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+// lastRequest returns the last request received by the test server
+func lastRequest(t *testing.T, requests *[]recordedRequest) recordedRequest {
+	t.Helper()
+	if len(*requests) == 0 {
+		t.Fatal("the server received no request")
+	}
+	return (*requests)[len(*requests)-1]
+}
+
+// checkCall checks the call recorded for the request
+func checkCall(t *testing.T, recorder *CallRecorder, want Call) {
+	t.Helper()
+	calls := recorder.Calls()
+	if len(calls) != 1 {
+		t.Fatalf("recorded %d calls, want 1", len(calls))
+	}
+	if calls[0] != want {
+		t.Errorf("recorded call %+v, want %+v", calls[0], want)
+	}
+}
+
+// field returns the value at the path of keys in a decoded JSON object, nil when missing
+func field(value any, keys ...string) any {
+	for _, key := range keys {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
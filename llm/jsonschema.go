@@ -0,0 +1,158 @@
+package llm
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// fencedBlock matches the content of markdown code fences, with or without a language
+var fencedBlock = regexp.MustCompile("(?s)```[a-zA-Z]*\\s*\\n(.*?)```")
+
+// ExtractJSON returns the JSON object of a model answer. The answer may be the bare
+// object, contain it in a fenced code block, or surround it with prose.
+func ExtractJSON(answer string) (string, error) {
+	answer = strings.TrimSpace(answer)
+	if json.Valid([]byte(answer)) {
+		return answer, nil
+	}
+	for _, match := range fencedBlock.FindAllStringSubmatch(answer, -1) {
+		block := strings.TrimSpace(match[1])
+		if json.Valid([]byte(block)) {
+			return block, nil
+		}
+	}
+	start := strings.Index(answer, "{")
+	end := strings.LastIndex(answer, "}")
+	if start >= 0 && end > start {
+		candidate := answer[start : end+1]
+		if json.Valid([]byte(candidate)) {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("no JSON object found in the answer")
+}
+
+// ValidateJSON checks data against a schema generated by GenerateSchema and returns the
+// problems found. Only the keywords produced for our response types are supported:
+// type, properties, required, additionalProperties, items and enum.
+func ValidateJSON(data string, schema any) ([]string, error) {
+	schemaMap, err := schemaToMap(schema)
+	if err != nil {
+		return nil, err
+	}
+	var value any
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		return []string{fmt.Sprintf("invalid JSON: %v", err)}, nil
+	}
+	var problems []string
+	validateValue("$", value, schemaMap, &problems)
+	return problems, nil
+}
+
+func validateValue(path string, value any, schema map[string]any, problems *[]string) {
+	if types := schemaTypes(schema["type"]); len(types) > 0 {
+		actual := jsonType(value)
+		if !typeAllowed(actual, types) {
+			*problems = append(*problems, fmt.Sprintf("%s: expected %s, got %s", path, strings.Join(types, " or "), actual))
+			return
+		}
+	}
+
+	if enum, ok := schema["enum"].([]any); ok && !inEnum(value, enum) {
+		*problems = append(*problems, fmt.Sprintf("%s: value is not one of the allowed values", path))
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		properties, _ := schema["properties"].(map[string]any)
+		if required, ok := schema["required"].([]any); ok {
+			for _, name := range required {
+				if key, ok := name.(string); ok {
+					if _, present := v[key]; !present {
+						*problems = append(*problems, fmt.Sprintf("%s: missing required property %q", path, key))
+					}
+				}
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			propSchema, known := properties[key].(map[string]any)
+			if !known {
+				if additional, ok := schema["additionalProperties"].(bool); ok && !additional {
+					*problems = append(*problems, fmt.Sprintf("%s: unexpected property %q", path, key))
+				}
+				continue
+			}
+			validateValue(path+"."+key, v[key], propSchema, problems)
+		}
+	case []any:
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range v {
+				validateValue(fmt.Sprintf("%s[%d]", path, i), item, items, problems)
+			}
+		}
+	}
+}
+
+func schemaTypes(t any) []string {
+	switch t := t.(type) {
+	case string:
+		return []string{t}
+	case []any:
+		var types []string
+		for _, v := range t {
+			if s, ok := v.(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+func jsonType(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == float64(int64(v)) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func typeAllowed(actual string, types []string) bool {
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func inEnum(value any, enum []any) bool {
+	encoded, _ := json.Marshal(value)
+	for _, allowed := range enum {
+		if e, _ := json.Marshal(allowed); string(e) == string(encoded) {
+			return true
+		}
+	}
+	return false
+}
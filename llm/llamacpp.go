@@ -0,0 +1,367 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const LLAMACPP_DEFAULT_BASE_URL = "http://localhost:8080"
+
+// LlamaCppProvider talks to the OpenAI-compatible endpoints of the llama.cpp server
+type LlamaCppProvider struct {
+	httpClient   *http.Client
+	apiKey       string
+	baseURL      string
+	systemPrompt string
+	model        modelResolver
+	timeout      time.Duration
+	retry        RetryPolicy
+}
+
+type LlamaCppProviderConfig struct {
+	APIKey       string // Optional, only needed when the server is started with --api-key
+	SystemPrompt string
+	Model        Model         // Optional, the model loaded by the server is used when empty
+	BaseUrl      string        // Optional, defaults to LLAMACPP_DEFAULT_BASE_URL
+	Timeout      time.Duration // Per-request timeout, 0 means no timeout
+	Retry        RetryPolicy   // Retry policy for failed requests
+	HTTPClient   *http.Client  // Optional, defaults to http.DefaultClient
+}
+
+func NewLlamaCppProvider(conf LlamaCppProviderConfig) *LlamaCppProvider {
+	baseURL := conf.BaseUrl
+	if baseURL == "" {
+		baseURL = LLAMACPP_DEFAULT_BASE_URL
+	}
+	log.Debugf("Setting llama.cpp base URL to: %s", baseURL)
+	httpClient := conf.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &LlamaCppProvider{
+		httpClient:   httpClient,
+		apiKey:       conf.APIKey,
+		baseURL:      baseURL,
+		systemPrompt: conf.SystemPrompt,
+		model:        modelResolver{model: conf.Model},
+		timeout:      conf.Timeout,
+		retry:        conf.Retry,
+	}
+}
+
+type llamaCppMessage struct {
+	Role       string             `json:"role"`
+	Content    string             `json:"content"`
+	ToolCalls  []llamaCppToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string             `json:"tool_call_id,omitempty"`
+}
+
+type llamaCppToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type llamaCppTool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string         `json:"name"`
+		Description string         `json:"description"`
+		Parameters  map[string]any `json:"parameters"`
+	} `json:"function"`
+}
+
+type llamaCppResponseFormat struct {
+	Type   string         `json:"type"`
+	Schema map[string]any `json:"schema,omitempty"`
+}
+
+type llamaCppChatRequest struct {
+	Model             string                  `json:"model,omitempty"`
+	Messages          []llamaCppMessage       `json:"messages"`
+	ResponseFormat    *llamaCppResponseFormat `json:"response_format,omitempty"`
+	Tools             []llamaCppTool          `json:"tools,omitempty"`
+	ParallelToolCalls *bool                   `json:"parallel_tool_calls,omitempty"`
+	Stream            bool                    `json:"stream,omitempty"`
+	Temperature       *float64                `json:"temperature,omitempty"`
+	TopP              *float64                `json:"top_p,omitempty"`
+	MaxTokens         *int                    `json:"max_tokens,omitempty"`
+	Seed              *int64                  `json:"seed,omitempty"`
+}
+
+type llamaCppChatChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+type llamaCppChatResponse struct {
+	Choices []struct {
+		Message llamaCppMessage `json:"message"`
+	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+type llamaCppModelsResponse struct {
+	Data []struct {
+		ID   string `json:"id"`
+		Meta struct {
+			NCtxTrain int `json:"n_ctx_train"`
+		} `json:"meta"`
+	} `json:"data"`
+}
+
+type llamaCppPropsResponse struct {
+	DefaultGenerationSettings struct {
+		NCtx int `json:"n_ctx"`
+	} `json:"default_generation_settings"`
+}
+
+func (p *LlamaCppProvider) RequestCompletion(ctx context.Context, prompt string) (string, error) {
+	log.Debugf("Requesting completion from llama.cpp with prompt: %s", prompt)
+	return p.Chat(ctx, ChatRequest{Messages: userMessages(prompt)})
+}
+
+// RequestCompletionWithJSONSchema constrains the output with the grammar generated by llama.cpp from the schema
+func (p *LlamaCppProvider) RequestCompletionWithJSONSchema(ctx context.Context, prompt string, schema any) (string, error) {
+	content, err := p.Chat(ctx, ChatRequest{Messages: userMessages(prompt), Schema: schema})
+	if err != nil {
+		return "", err
+	}
+	log.Debugf("llama.cpp response: %s", content)
+	return content, nil
+}
+
+func (p *LlamaCppProvider) StreamCompletion(ctx context.Context, prompt string, onDelta func(string)) (string, error) {
+	log.Debugf("Streaming completion from llama.cpp with prompt: %s", prompt)
+	return p.Chat(ctx, ChatRequest{Messages: userMessages(prompt), OnDelta: onDelta})
+}
+
+func (p *LlamaCppProvider) StreamCompletionWithJSONSchema(ctx context.Context, prompt string, schema any, onDelta func(string)) (string, error) {
+	return p.Chat(ctx, ChatRequest{Messages: userMessages(prompt), Schema: schema, OnDelta: onDelta})
+}
+
+// Chat sends the conversation, the server reuses the KV cache of the common prefix with the last request
+func (p *LlamaCppProvider) Chat(ctx context.Context, req ChatRequest) (string, error) {
+	var format *llamaCppResponseFormat
+	if req.Schema != nil {
+		schemaMap, err := schemaToMap(req.Schema)
+		if err != nil {
+			return "", err
+		}
+		format = &llamaCppResponseFormat{Type: "json_object", Schema: schemaMap}
+	}
+	if req.OnDelta != nil {
+		return p.streamChat(ctx, llamaCppMessages(req.Messages), format, req.OnDelta)
+	}
+	return p.chat(ctx, llamaCppMessages(req.Messages), format)
+}
+
+// newChatRequest sends the system prompt of the provider followed by the messages
+func (p *LlamaCppProvider) newChatRequest(ctx context.Context, model Model, messages []llamaCppMessage, format *llamaCppResponseFormat) llamaCppChatRequest {
+	all := []llamaCppMessage{}
+	if p.systemPrompt != "" {
+		all = append(all, llamaCppMessage{Role: "system", Content: p.systemPrompt})
+	}
+	all = append(all, messages...)
+
+	generation := generationParams(ctx, model)
+	return llamaCppChatRequest{
+		Model:          model.Name,
+		Messages:       all,
+		ResponseFormat: format,
+		Temperature:    generation.Temperature,
+		TopP:           generation.TopP,
+		MaxTokens:      generation.MaxTokens,
+		Seed:           generation.Seed,
+	}
+}
+
+func (p *LlamaCppProvider) chat(ctx context.Context, messages []llamaCppMessage, format *llamaCppResponseFormat) (string, error) {
+	model, err := p.model.resolve(ctx, p)
+	if err != nil {
+		return "", err
+	}
+	resp, err := p.send(ctx, model, p.newChatRequest(ctx, model, messages, format))
+	if err != nil {
+		return "", err
+	}
+	return resp.Choices[0].Message.Content, nil
+}
+
+func (p *LlamaCppProvider) send(ctx context.Context, model Model, req llamaCppChatRequest) (*llamaCppChatResponse, error) {
+	url := joinURL(p.baseURL, "v1/chat/completions")
+	resp, err := withRetry(ctx, p.retry, p.timeout, func(ctx context.Context) (*llamaCppChatResponse, error) {
+		var resp llamaCppChatResponse
+		if err := postJSON(ctx, p.httpClient, url, p.headers(), req, &resp); err != nil {
+			return nil, err
+		}
+		return &resp, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	recordCall(ctx, Call{
+		Model: model.Name,
+		Usage: Usage{PromptTokens: resp.Usage.PromptTokens, CompletionTokens: resp.Usage.CompletionTokens},
+	})
+	if len(resp.Choices) == 0 {
+		return nil, fmt.Errorf("llama.cpp returned no choices")
+	}
+	return resp, nil
+}
+
+// streamChat reads the OpenAI-style server-sent events of the llama.cpp server
+func (p *LlamaCppProvider) streamChat(ctx context.Context, messages []llamaCppMessage, format *llamaCppResponseFormat, onDelta func(string)) (string, error) {
+	model, err := p.model.resolve(ctx, p)
+	if err != nil {
+		return "", err
+	}
+	req := p.newChatRequest(ctx, model, messages, format)
+	req.Stream = true
+
+	url := joinURL(p.baseURL, "v1/chat/completions")
+	tracker := &deltaTracker{onDelta: onDelta}
+	var usage Usage
+	_, err = withRetry(ctx, p.retry, p.timeout, func(ctx context.Context) (struct{}, error) {
+		resp, err := doJSON(ctx, p.httpClient, http.MethodPost, url, p.headers(), req)
+		if err != nil {
+			return struct{}{}, err
+		}
+		defer resp.Body.Close()
+
+		var streamErr error
+		err = readSSE(resp.Body, func(_ string, data string) bool {
+			if data == "[DONE]" {
+				return false
+			}
+			var chunk llamaCppChatChunk
+			if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+				streamErr = fmt.Errorf("invalid llama.cpp stream chunk: %w", err)
+				return false
+			}
+			if chunk.Usage != nil {
+				usage = Usage{PromptTokens: chunk.Usage.PromptTokens, CompletionTokens: chunk.Usage.CompletionTokens}
+			}
+			if len(chunk.Choices) > 0 {
+				tracker.emit(chunk.Choices[0].Delta.Content)
+			}
+			return true
+		})
+		if err == nil {
+			err = streamErr
+		}
+		if err != nil {
+			return struct{}{}, tracker.fail(err)
+		}
+		return struct{}{}, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	recordCall(ctx, Call{Model: model.Name, Usage: usage})
+	return tracker.text.String(), nil
+}
+
+// Model returns the configured model, or the discovered one once a request was sent
+func (p *LlamaCppProvider) Model() Model {
+	return p.model.current()
+}
+
+// ListModels returns the model loaded by the server, with the context size it was started with
+func (p *LlamaCppProvider) ListModels(ctx context.Context) ([]Model, error) {
+	var list llamaCppModelsResponse
+	if err := getJSON(ctx, p.httpClient, joinURL(p.baseURL, "v1/models"), p.headers(), &list); err != nil {
+		return nil, err
+	}
+
+	// The context actually allocated by the server can be smaller than the training context
+	var props llamaCppPropsResponse
+	if err := getJSON(ctx, p.httpClient, joinURL(p.baseURL, "props"), p.headers(), &props); err != nil {
+		log.Debugf("Failed to get llama.cpp server properties: %v", err)
+	}
+
+	models := make([]Model, 0, len(list.Data))
+	for _, m := range list.Data {
+		contextSize := props.DefaultGenerationSettings.NCtx
+		if contextSize == 0 {
+			contextSize = m.Meta.NCtxTrain
+		}
+		models = append(models, Model{Name: m.ID, ContextSize: contextSize})
+	}
+	return models, nil
+}
+
+func (p *LlamaCppProvider) headers() map[string]string {
+	if p.apiKey == "" {
+		return nil
+	}
+	return map[string]string{"Authorization": "Bearer " + p.apiKey}
+}
+
+// RequestToolCalls uses the OpenAI-style function calling of llama.cpp, one call at a time.
+// The server must be started with --jinja.
+func (p *LlamaCppProvider) RequestToolCalls(ctx context.Context, messages []Message, tools []Tool) (Message, error) {
+	model, err := p.model.resolve(ctx, p)
+	if err != nil {
+		return Message{}, err
+	}
+	req := p.newChatRequest(ctx, model, llamaCppMessages(messages), nil)
+	parallel := false
+	req.ParallelToolCalls = &parallel
+	for _, tool := range tools {
+		parameters, err := schemaToMap(tool.Parameters)
+		if err != nil {
+			return Message{}, err
+		}
+		t := llamaCppTool{Type: "function"}
+		t.Function.Name = tool.Name
+		t.Function.Description = tool.Description
+		t.Function.Parameters = parameters
+		req.Tools = append(req.Tools, t)
+	}
+
+	resp, err := p.send(ctx, model, req)
+	if err != nil {
+		return Message{}, err
+	}
+	msg := resp.Choices[0].Message
+	answer := Message{Role: ROLE_ASSISTANT, Content: msg.Content}
+	for _, call := range msg.ToolCalls {
+		answer.ToolCalls = append(answer.ToolCalls, ToolCall{ID: call.ID, Name: call.Function.Name, Arguments: call.Function.Arguments})
+	}
+	return answer, nil
+}
+
+func llamaCppMessages(messages []Message) []llamaCppMessage {
+	var res []llamaCppMessage
+	for _, m := range messages {
+		msg := llamaCppMessage{Role: m.Role, Content: m.Content, ToolCallID: m.ToolCallID}
+		for _, call := range m.ToolCalls {
+			tc := llamaCppToolCall{ID: call.ID, Type: "function"}
+			tc.Function.Name = call.Name
+			tc.Function.Arguments = call.Arguments
+			msg.ToolCalls = append(msg.ToolCalls, tc)
+		}
+		res = append(res, msg)
+	}
+	return res
+}
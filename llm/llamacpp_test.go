@@ -0,0 +1,100 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestLlamaCppRequestCompletion(t *testing.T) {
+	server, requests := newTestServer(t, map[string]string{
+		"/v1/chat/completions": `{
+			"choices": [{"message": {"role": "assistant", "content": "The disk is full."}}],
+			"usage": {"prompt_tokens": 10, "completion_tokens": 5}
+		}`,
+	})
+	recorder := &CallRecorder{}
+	ctx := WithCallRecorder(context.Background(), recorder)
+	provider := NewLlamaCppProvider(LlamaCppProviderConfig{
+		APIKey:       "test-key",
+		SystemPrompt: "You are a test.",
+		Model:        Model{Name: "qwen3"},
+		BaseUrl:      server.URL,
+	})
+
+	answer, err := provider.RequestCompletion(ctx, "Why is the host slow?")
+	if err != nil {
+		t.Fatalf("RequestCompletion failed: %v", err)
+	}
+	if answer != "The disk is full." {
+		t.Errorf("answer %q, want %q", answer, "The disk is full.")
+	}
+
+	req := lastRequest(t, requests)
+	if got := req.Header.Get("Authorization"); got != "Bearer test-key" {
+		t.Errorf("Authorization %q, want the API key", got)
+	}
+	if got := field(req.Body, "model"); got != "qwen3" {
+		t.Errorf("model %v, want qwen3", got)
+	}
+	messages, _ := field(req.Body, "messages").([]any)
+	if len(messages) != 2 || field(messages[0], "role") != "system" || field(messages[1], "content") != "Why is the host slow?" {
+		t.Errorf("messages %v, want the system prompt and the prompt", messages)
+	}
+	if got := field(req.Body, "response_format"); got != nil {
+		t.Errorf("response_format %v, want none", got)
+	}
+	checkCall(t, recorder, Call{Model: "qwen3", Usage: Usage{PromptTokens: 10, CompletionTokens: 5}})
+}
+
+func TestLlamaCppRequestCompletionWithJSONSchema(t *testing.T) {
+	server, requests := newTestServer(t, map[string]string{
+		"/v1/chat/completions": `{
+			"choices": [{"message": {"role": "assistant", "content": "{\"verdict\": \"safe\"}"}}],
+			"usage": {"prompt_tokens": 12, "completion_tokens": 7}
+		}`,
+	})
+	recorder := &CallRecorder{}
+	ctx := WithCallRecorder(context.Background(), recorder)
+	provider := NewLlamaCppProvider(LlamaCppProviderConfig{Model: Model{Name: "qwen3"}, BaseUrl: server.URL})
+
+	answer, err := provider.RequestCompletionWithJSONSchema(ctx, "Is ls safe?", GenerateSchema[testAnswer]())
+	if err != nil {
+		t.Fatalf("RequestCompletionWithJSONSchema failed: %v", err)
+	}
+	var parsed testAnswer
+	if err := json.Unmarshal([]byte(answer), &parsed); err != nil || parsed.Verdict != "safe" {
+		t.Errorf("answer %q, want the JSON content of the message", answer)
+	}
+
+	req := lastRequest(t, requests)
+	if got := req.Header.Get("Authorization"); got != "" {
+		t.Errorf("Authorization %q, want none without an API key", got)
+	}
+	if got := field(req.Body, "response_format", "type"); got != "json_object" {
+		t.Errorf("response_format type %v, want json_object", got)
+	}
+	if got := field(req.Body, "response_format", "schema", "properties", "verdict", "type"); got != "string" {
+		t.Errorf("response_format %v, want the requested schema", field(req.Body, "response_format"))
+	}
+	checkCall(t, recorder, Call{Model: "qwen3", Usage: Usage{PromptTokens: 12, CompletionTokens: 7}})
+}
+
+func TestLlamaCppDiscoversModel(t *testing.T) {
+	server, requests := newTestServer(t, map[string]string{
+		"/v1/models":           `{"data": [{"id": "qwen3.gguf", "meta": {"n_ctx_train": 40960}}]}`,
+		"/props":               `{"default_generation_settings": {"n_ctx": 8192}}`,
+		"/v1/chat/completions": `{"choices": [{"message": {"role": "assistant", "content": "ok"}}]}`,
+	})
+	provider := NewLlamaCppProvider(LlamaCppProviderConfig{BaseUrl: server.URL})
+
+	if _, err := provider.RequestCompletion(context.Background(), "ping"); err != nil {
+		t.Fatalf("RequestCompletion failed: %v", err)
+	}
+	if got := field(lastRequest(t, requests).Body, "model"); got != "qwen3.gguf" {
+		t.Errorf("model %v, want the discovered qwen3.gguf", got)
+	}
+	if model := provider.Model(); model.ContextSize != 8192 {
+		t.Errorf("context size %d, want the context of the server", model.ContextSize)
+	}
+}
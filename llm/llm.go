@@ -1,6 +1,7 @@
 package llm
 
 import (
+	"context"
 	"fmt"
 )
 
@@ -11,18 +12,20 @@ type Model struct {
 }
 
 // Define the interface
+// Implementations must stop waiting and return ctx.Err() once ctx is done.
 type Provider interface {
-    RequestCompletion(string) (string, error)
-	RequestCompletionWithJSONSchema(string,  interface{}) (string, error)
+    RequestCompletion(ctx context.Context, prompt string) (string, error)
+	RequestCompletionWithJSONSchema(ctx context.Context, prompt string, schema interface{}) (string, error)
+	Model() Model // The model answering the requests
 }
 
-func AnalyzeCommands(results map[string]string, provider Provider) string {
+func AnalyzeCommands(ctx context.Context, results map[string]string, provider Provider) string {
     cmdOutput := ""
     for cmd, out := range results {
         cmdOutput += fmt.Sprintf("Command: %s\nOutput:\n%s\n\n", cmd, out)
     }
     
-	res, err := provider.RequestCompletion(cmdOutput)
+	res, err := provider.RequestCompletion(ctx, cmdOutput)
 	if err != nil {
 		return fmt.Sprintf("Error analyzing commands: %v", err)
 	}
@@ -30,3 +33,8 @@ func AnalyzeCommands(results map[string]string, provider Provider) string {
 	return res
 }
 
+
+// ModelLister is implemented by providers able to discover the models served by their backend
+type ModelLister interface {
+	ListModels(ctx context.Context) ([]Model, error)
+}
@@ -9,3 +9,25 @@ var OPENAI_GPT41_Mini = Model{
 	Name:        "gpt-4.1-mini",
 	ContextSize: 1000000, // 1M tokens
 }
+
+var ANTHROPIC_CLAUDE_SONNET_4 = Model{
+	Name:        "claude-sonnet-4-20250514",
+	ContextSize: 200000, // 200k tokens
+}
+
+// KnownModels lists the models whose properties are known without asking the provider
+var KnownModels = []Model{
+	OPENAI_GPT4o,
+	OPENAI_GPT41_Mini,
+	ANTHROPIC_CLAUDE_SONNET_4,
+}
+
+// LookupModel returns the known model with this name, or a model with an unknown context size
+func LookupModel(name string) Model {
+	for _, m := range KnownModels {
+		if m.Name == name {
+			return m
+		}
+	}
+	return Model{Name: name}
+}
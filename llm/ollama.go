@@ -0,0 +1,361 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const OLLAMA_DEFAULT_BASE_URL = "http://localhost:11434"
+
+// OLLAMA_MAX_DISCOVERED_CONTEXT caps the context size of the discovered models, as Ollama
+// allocates the memory of the whole window. Set context_size in the profile for a larger one.
+const OLLAMA_MAX_DISCOVERED_CONTEXT = 8192
+
+// OllamaProvider talks to the native Ollama chat API, no data leaves the host running Ollama
+type OllamaProvider struct {
+	httpClient   *http.Client
+	baseURL      string
+	systemPrompt string
+	model        modelResolver
+	timeout      time.Duration
+	retry        RetryPolicy
+}
+
+type OllamaProviderConfig struct {
+	SystemPrompt string
+	Model        Model         // Optional, the first model served by Ollama is used when empty
+	BaseUrl      string        // Optional, defaults to OLLAMA_DEFAULT_BASE_URL
+	Timeout      time.Duration // Per-request timeout, 0 means no timeout
+	Retry        RetryPolicy   // Retry policy for failed requests
+	HTTPClient   *http.Client  // Optional, defaults to http.DefaultClient
+}
+
+func NewOllamaProvider(conf OllamaProviderConfig) *OllamaProvider {
+	baseURL := conf.BaseUrl
+	if baseURL == "" {
+		baseURL = OLLAMA_DEFAULT_BASE_URL
+	}
+	log.Debugf("Setting Ollama base URL to: %s", baseURL)
+	httpClient := conf.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &OllamaProvider{
+		httpClient:   httpClient,
+		baseURL:      baseURL,
+		systemPrompt: conf.SystemPrompt,
+		model:        modelResolver{model: conf.Model},
+		timeout:      conf.Timeout,
+		retry:        conf.Retry,
+	}
+}
+
+type ollamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"` // For tool messages
+}
+
+type ollamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"` // A JSON object, not a string as in the OpenAI API
+	} `json:"function"`
+}
+
+type ollamaTool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string         `json:"name"`
+		Description string         `json:"description"`
+		Parameters  map[string]any `json:"parameters"`
+	} `json:"function"`
+}
+
+type ollamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Tools    []ollamaTool    `json:"tools,omitempty"`
+	Stream   bool            `json:"stream"`
+	Format   any             `json:"format,omitempty"` // "json" or a JSON schema
+	Options  map[string]any  `json:"options,omitempty"`
+}
+
+type ollamaChatResponse struct {
+	Message         ollamaMessage `json:"message"`
+	Done            bool          `json:"done"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+	Error           string        `json:"error,omitempty"` // Set when the stream fails after it started
+}
+
+type ollamaTagsResponse struct {
+	Models []struct {
+		Name string `json:"name"`
+	} `json:"models"`
+}
+
+type ollamaShowResponse struct {
+	ModelInfo map[string]any `json:"model_info"`
+}
+
+func (p *OllamaProvider) RequestCompletion(ctx context.Context, prompt string) (string, error) {
+	log.Debugf("Requesting completion from Ollama with prompt: %s", prompt)
+	return p.Chat(ctx, ChatRequest{Messages: userMessages(prompt)})
+}
+
+// RequestCompletionWithJSONSchema uses the Ollama structured outputs, passing the schema as "format"
+func (p *OllamaProvider) RequestCompletionWithJSONSchema(ctx context.Context, prompt string, schema any) (string, error) {
+	res, err := p.Chat(ctx, ChatRequest{Messages: userMessages(prompt), Schema: schema})
+	if err != nil {
+		return "", err
+	}
+	log.Debugf("Ollama response: %s", res)
+	return res, nil
+}
+
+func (p *OllamaProvider) StreamCompletion(ctx context.Context, prompt string, onDelta func(string)) (string, error) {
+	log.Debugf("Streaming completion from Ollama with prompt: %s", prompt)
+	return p.Chat(ctx, ChatRequest{Messages: userMessages(prompt), OnDelta: onDelta})
+}
+
+func (p *OllamaProvider) StreamCompletionWithJSONSchema(ctx context.Context, prompt string, schema any, onDelta func(string)) (string, error) {
+	return p.Chat(ctx, ChatRequest{Messages: userMessages(prompt), Schema: schema, OnDelta: onDelta})
+}
+
+// Chat sends the conversation, Ollama keeps the evaluated prefix of the last request in its cache
+func (p *OllamaProvider) Chat(ctx context.Context, req ChatRequest) (string, error) {
+	var format any
+	if req.Schema != nil {
+		schemaMap, err := schemaToMap(req.Schema)
+		if err != nil {
+			return "", err
+		}
+		format = schemaMap
+	}
+	if req.OnDelta != nil {
+		return p.streamChat(ctx, ollamaMessages(req.Messages), format, req.OnDelta)
+	}
+	resp, err := p.chat(ctx, ollamaMessages(req.Messages), format)
+	if err != nil {
+		return "", err
+	}
+	return resp.Message.Content, nil
+}
+
+// newChatRequest sends the system prompt of the provider followed by the messages
+func (p *OllamaProvider) newChatRequest(ctx context.Context, model Model, messages []ollamaMessage, format any) ollamaChatRequest {
+	all := []ollamaMessage{}
+	if p.systemPrompt != "" {
+		all = append(all, ollamaMessage{Role: "system", Content: p.systemPrompt})
+	}
+	all = append(all, messages...)
+
+	req := ollamaChatRequest{
+		Model:    model.Name,
+		Messages: all,
+		Stream:   false,
+		Format:   format,
+	}
+	// Ollama defaults to a small context window, ask for the one the prompts are budgeted for
+	options := map[string]any{"num_ctx": model.ContextSizeOrDefault()}
+	generation := generationParams(ctx, model)
+	if generation.Temperature != nil {
+		options["temperature"] = *generation.Temperature
+	}
+	if generation.TopP != nil {
+		options["top_p"] = *generation.TopP
+	}
+	if generation.MaxTokens != nil {
+		options["num_predict"] = *generation.MaxTokens
+	}
+	if generation.Seed != nil {
+		options["seed"] = *generation.Seed
+	}
+	req.Options = options
+	return req
+}
+
+func (p *OllamaProvider) chat(ctx context.Context, messages []ollamaMessage, format any) (*ollamaChatResponse, error) {
+	model, err := p.model.resolve(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return p.send(ctx, model, p.newChatRequest(ctx, model, messages, format))
+}
+
+func (p *OllamaProvider) send(ctx context.Context, model Model, req ollamaChatRequest) (*ollamaChatResponse, error) {
+	url := joinURL(p.baseURL, "api/chat")
+	resp, err := withRetry(ctx, p.retry, p.timeout, func(ctx context.Context) (*ollamaChatResponse, error) {
+		var resp ollamaChatResponse
+		if err := postJSON(ctx, p.httpClient, url, nil, req, &resp); err != nil {
+			return nil, err
+		}
+		return &resp, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	recordCall(ctx, Call{
+		Model: model.Name,
+		Usage: Usage{PromptTokens: resp.PromptEvalCount, CompletionTokens: resp.EvalCount},
+	})
+	return resp, nil
+}
+
+// streamChat reads the newline-delimited JSON stream of Ollama, the last message carries the token counts
+func (p *OllamaProvider) streamChat(ctx context.Context, messages []ollamaMessage, format any, onDelta func(string)) (string, error) {
+	model, err := p.model.resolve(ctx, p)
+	if err != nil {
+		return "", err
+	}
+	req := p.newChatRequest(ctx, model, messages, format)
+	req.Stream = true
+
+	url := joinURL(p.baseURL, "api/chat")
+	tracker := &deltaTracker{onDelta: onDelta}
+	var usage Usage
+	_, err = withRetry(ctx, p.retry, p.timeout, func(ctx context.Context) (struct{}, error) {
+		resp, err := doJSON(ctx, p.httpClient, http.MethodPost, url, nil, req)
+		if err != nil {
+			return struct{}{}, err
+		}
+		defer resp.Body.Close()
+
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			var chunk ollamaChatResponse
+			if err := decoder.Decode(&chunk); err == io.EOF {
+				return struct{}{}, tracker.fail(io.ErrUnexpectedEOF)
+			} else if err != nil {
+				return struct{}{}, tracker.fail(err)
+			}
+			if chunk.Error != "" {
+				return struct{}{}, tracker.fail(&APIError{StatusCode: http.StatusInternalServerError, Body: chunk.Error})
+			}
+			tracker.emit(chunk.Message.Content)
+			if chunk.Done {
+				usage = Usage{PromptTokens: chunk.PromptEvalCount, CompletionTokens: chunk.EvalCount}
+				return struct{}{}, nil
+			}
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	recordCall(ctx, Call{Model: model.Name, Usage: usage})
+	return tracker.text.String(), nil
+}
+
+// Model returns the configured model, or the discovered one once a request was sent
+func (p *OllamaProvider) Model() Model {
+	return p.model.current()
+}
+
+// ListModels returns the models pulled on the Ollama server, with their context length when
+// available, capped to OLLAMA_MAX_DISCOVERED_CONTEXT
+func (p *OllamaProvider) ListModels(ctx context.Context) ([]Model, error) {
+	var tags ollamaTagsResponse
+	if err := getJSON(ctx, p.httpClient, joinURL(p.baseURL, "api/tags"), nil, &tags); err != nil {
+		return nil, err
+	}
+
+	models := make([]Model, 0, len(tags.Models))
+	for _, m := range tags.Models {
+		model := Model{Name: m.Name}
+		var show ollamaShowResponse
+		err := postJSON(ctx, p.httpClient, joinURL(p.baseURL, "api/show"), nil, map[string]string{"model": m.Name}, &show)
+		if err != nil {
+			log.Debugf("Failed to get details for Ollama model %s: %v", m.Name, err)
+		} else {
+			model.ContextSize = min(ollamaContextLength(show.ModelInfo), OLLAMA_MAX_DISCOVERED_CONTEXT)
+		}
+		models = append(models, model)
+	}
+	return models, nil
+}
+
+// ollamaContextLength reads the "<architecture>.context_length" entry of the model info
+func ollamaContextLength(info map[string]any) int {
+	for key, value := range info {
+		if !strings.HasSuffix(key, ".context_length") {
+			continue
+		}
+		switch v := value.(type) {
+		case float64:
+			return int(v)
+		case json.Number:
+			n, _ := v.Int64()
+			return int(n)
+		}
+	}
+	return 0
+}
+
+// RequestToolCalls uses the Ollama tool support, which needs a model trained for tool calling
+func (p *OllamaProvider) RequestToolCalls(ctx context.Context, messages []Message, tools []Tool) (Message, error) {
+	model, err := p.model.resolve(ctx, p)
+	if err != nil {
+		return Message{}, err
+	}
+	req := p.newChatRequest(ctx, model, ollamaMessages(messages), nil)
+	for _, tool := range tools {
+		parameters, err := schemaToMap(tool.Parameters)
+		if err != nil {
+			return Message{}, err
+		}
+		t := ollamaTool{Type: "function"}
+		t.Function.Name = tool.Name
+		t.Function.Description = tool.Description
+		t.Function.Parameters = parameters
+		req.Tools = append(req.Tools, t)
+	}
+
+	resp, err := p.send(ctx, model, req)
+	if err != nil {
+		return Message{}, err
+	}
+	answer := Message{Role: ROLE_ASSISTANT, Content: resp.Message.Content}
+	for i, call := range resp.Message.ToolCalls {
+		// Ollama does not identify the calls
+		answer.ToolCalls = append(answer.ToolCalls, ToolCall{
+			ID:        fmt.Sprintf("call_%d_%d", len(messages), i),
+			Name:      call.Function.Name,
+			Arguments: string(call.Function.Arguments),
+		})
+	}
+	return answer, nil
+}
+
+// ollamaMessages converts the conversation, tool messages are identified by the tool name
+func ollamaMessages(messages []Message) []ollamaMessage {
+	toolNames := map[string]string{}
+	var res []ollamaMessage
+	for _, m := range messages {
+		msg := ollamaMessage{Role: m.Role, Content: m.Content}
+		for _, call := range m.ToolCalls {
+			toolNames[call.ID] = call.Name
+			var tc ollamaToolCall
+			tc.Function.Name = call.Name
+			tc.Function.Arguments = json.RawMessage(call.Arguments)
+			if len(tc.Function.Arguments) == 0 {
+				tc.Function.Arguments = json.RawMessage("{}")
+			}
+			msg.ToolCalls = append(msg.ToolCalls, tc)
+		}
+		if m.Role == ROLE_TOOL {
+			msg.ToolName = toolNames[m.ToolCallID]
+		}
+		res = append(res, msg)
+	}
+	return res
+}
@@ -0,0 +1,127 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestOllamaRequestCompletion(t *testing.T) {
+	server, requests := newTestServer(t, map[string]string{
+		"/api/chat": `{
+			"message": {"role": "assistant", "content": "The disk is full."},
+			"done": true,
+			"prompt_eval_count": 10,
+			"eval_count": 5
+		}`,
+	})
+	recorder := &CallRecorder{}
+	ctx := WithCallRecorder(context.Background(), recorder)
+	provider := NewOllamaProvider(OllamaProviderConfig{SystemPrompt: "You are a test.", Model: Model{Name: "llama3"}, BaseUrl: server.URL})
+
+	answer, err := provider.RequestCompletion(ctx, "Why is the host slow?")
+	if err != nil {
+		t.Fatalf("RequestCompletion failed: %v", err)
+	}
+	if answer != "The disk is full." {
+		t.Errorf("answer %q, want %q", answer, "The disk is full.")
+	}
+
+	req := lastRequest(t, requests)
+	if got := field(req.Body, "model"); got != "llama3" {
+		t.Errorf("model %v, want llama3", got)
+	}
+	if got := field(req.Body, "stream"); got != false {
+		t.Errorf("stream %v, want false", got)
+	}
+	messages, _ := field(req.Body, "messages").([]any)
+	if len(messages) != 2 || field(messages[0], "role") != "system" || field(messages[1], "content") != "Why is the host slow?" {
+		t.Errorf("messages %v, want the system prompt and the prompt", messages)
+	}
+	if got := field(req.Body, "format"); got != nil {
+		t.Errorf("format %v, want none", got)
+	}
+	// The prompts are budgeted for the default context size when the profile does not set one
+	if got := field(req.Body, "options", "num_ctx"); got != float64(DEFAULT_CONTEXT_SIZE) {
+		t.Errorf("num_ctx %v, want %d", got, DEFAULT_CONTEXT_SIZE)
+	}
+	checkCall(t, recorder, Call{Model: "llama3", Usage: Usage{PromptTokens: 10, CompletionTokens: 5}})
+}
+
+func TestOllamaRequestCompletionWithJSONSchema(t *testing.T) {
+	server, requests := newTestServer(t, map[string]string{
+		"/api/chat": `{
+			"message": {"role": "assistant", "content": "{\"verdict\": \"safe\"}"},
+			"done": true,
+			"prompt_eval_count": 12,
+			"eval_count": 7
+		}`,
+	})
+	recorder := &CallRecorder{}
+	ctx := WithCallRecorder(context.Background(), recorder)
+	provider := NewOllamaProvider(OllamaProviderConfig{Model: Model{Name: "llama3", ContextSize: 4096}, BaseUrl: server.URL})
+
+	answer, err := provider.RequestCompletionWithJSONSchema(ctx, "Is ls safe?", GenerateSchema[testAnswer]())
+	if err != nil {
+		t.Fatalf("RequestCompletionWithJSONSchema failed: %v", err)
+	}
+	var parsed testAnswer
+	if err := json.Unmarshal([]byte(answer), &parsed); err != nil || parsed.Verdict != "safe" {
+		t.Errorf("answer %q, want the JSON content of the message", answer)
+	}
+
+	req := lastRequest(t, requests)
+	if got := field(req.Body, "format", "properties", "verdict", "type"); got != "string" {
+		t.Errorf("format %v, want the requested schema", field(req.Body, "format"))
+	}
+	if got := field(req.Body, "format", "$schema"); got != nil {
+		t.Errorf("format has $schema %v, want it removed", got)
+	}
+	if got := field(req.Body, "options", "num_ctx"); got != float64(4096) {
+		t.Errorf("num_ctx %v, want the context size of the profile", got)
+	}
+	checkCall(t, recorder, Call{Model: "llama3", Usage: Usage{PromptTokens: 12, CompletionTokens: 7}})
+}
+
+func TestOllamaDiscoversModel(t *testing.T) {
+	server, requests := newTestServer(t, map[string]string{
+		"/api/tags": `{"models": [{"name": "qwen3"}]}`,
+		"/api/show": `{"model_info": {"qwen3.context_length": 131072}}`,
+		"/api/chat": `{"message": {"role": "assistant", "content": "ok"}, "done": true}`,
+	})
+	provider := NewOllamaProvider(OllamaProviderConfig{BaseUrl: server.URL})
+
+	if _, err := provider.RequestCompletion(context.Background(), "ping"); err != nil {
+		t.Fatalf("RequestCompletion failed: %v", err)
+	}
+	req := lastRequest(t, requests)
+	if got := field(req.Body, "model"); got != "qwen3" {
+		t.Errorf("model %v, want the discovered qwen3", got)
+	}
+	if got := field(req.Body, "options", "num_ctx"); got != float64(OLLAMA_MAX_DISCOVERED_CONTEXT) {
+		t.Errorf("num_ctx %v, want the discovered context capped to %d", got, OLLAMA_MAX_DISCOVERED_CONTEXT)
+	}
+}
+
+func TestOllamaKeepsConfiguredContextSize(t *testing.T) {
+	server, requests := newTestServer(t, map[string]string{
+		"/api/tags": `{"models": [{"name": "qwen3"}]}`,
+		"/api/show": `{"model_info": {"qwen3.context_length": 131072}}`,
+		"/api/chat": `{"message": {"role": "assistant", "content": "ok"}, "done": true}`,
+	})
+	provider := NewOllamaProvider(OllamaProviderConfig{Model: Model{ContextSize: 32768}, BaseUrl: server.URL})
+
+	if _, err := provider.RequestCompletion(context.Background(), "ping"); err != nil {
+		t.Fatalf("RequestCompletion failed: %v", err)
+	}
+	req := lastRequest(t, requests)
+	if got := field(req.Body, "model"); got != "qwen3" {
+		t.Errorf("model %v, want the discovered qwen3", got)
+	}
+	if got := field(req.Body, "options", "num_ctx"); got != float64(32768) {
+		t.Errorf("num_ctx %v, want the context size of the profile", got)
+	}
+	if model := provider.Model(); model.ContextSize != 32768 {
+		t.Errorf("context size %d, want the context size of the profile", model.ContextSize)
+	}
+}
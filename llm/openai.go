@@ -3,12 +3,14 @@ package llm
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/invopop/jsonschema"
 	openai "github.com/openai/openai-go"
 	"github.com/openai/openai-go/azure"
 	"github.com/openai/openai-go/option"
+	"github.com/openai/openai-go/shared"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -17,6 +19,9 @@ type OpenAIProvider struct {
 	client       openai.Client
 	systemPrompt string
 	model        Model
+	deployment   string // Azure deployment the requests are sent to, in place of the model name
+	timeout      time.Duration
+	retry        RetryPolicy
 }
 
 type OpenAIProviderConfig struct {
@@ -24,7 +29,9 @@ type OpenAIProviderConfig struct {
 	SystemPrompt string
 	Model        Model
 	BaseUrl      string
-	AzureConfig  *AzureConfig // Optional, for Azure OpenAI
+	AzureConfig  *AzureConfig  // Optional, for Azure OpenAI
+	Timeout      time.Duration // Per-request timeout, 0 means no timeout
+	Retry        RetryPolicy   // Retry policy for failed requests
 }
 
 func NewOpenAIProvider(conf OpenAIProviderConfig) *OpenAIProvider {
@@ -38,6 +45,8 @@ func NewOpenAIProvider(conf OpenAIProviderConfig) *OpenAIProvider {
 		if err != nil {
 			log.Fatalf("Failed to create Azure OpenAI provider: %v", err)
 		}
+		op.timeout = conf.Timeout
+		op.retry = conf.Retry
 		return op
 	}
 	// Create Native OpenAI provider
@@ -58,6 +67,8 @@ func NewNativeOpenAIProvider(c OpenAIProviderConfig) *OpenAIProvider {
 		log.Debugf("Setting OpenAI base URL to: %s", c.BaseUrl)
 		opts = append(opts, option.WithBaseURL(c.BaseUrl))
 	}
+	// Retries are handled by withRetry so that every provider behaves the same
+	opts = append(opts, option.WithMaxRetries(0))
 	log.Debugf("Options for OpenAI client: %v", opts)
 
 	client := openai.NewClient(opts...)
@@ -65,6 +76,8 @@ func NewNativeOpenAIProvider(c OpenAIProviderConfig) *OpenAIProvider {
 		client:       client,
 		systemPrompt: c.SystemPrompt,
 		model:        c.Model,
+		timeout:      c.Timeout,
+		retry:        c.Retry,
 	}
 }
 
@@ -88,8 +101,14 @@ func NewAzureOpenAIProvider(cfg AzureConfig, systemPrompt string, model Model) (
 		}
 		opts = append(opts, azure.WithTokenCredential(cred))
 	}
+	opts = append(opts, option.WithMaxRetries(0))
 	client := openai.NewClient(opts...)
-	return &OpenAIProvider{client: client, systemPrompt: systemPrompt, model: Model{Name: cfg.DeploymentName}}, nil
+	// Azure routes requests by deployment name, which is sent as the model name. The name of
+	// the model is kept for the pricing and the context size, when the profile sets it.
+	if model.Name == "" {
+		model.Name = cfg.DeploymentName
+	}
+	return &OpenAIProvider{client: client, systemPrompt: systemPrompt, model: model, deployment: cfg.DeploymentName, retry: DefaultRetryPolicy}, nil
 }
 
 func GenerateSchema[T any]() interface{} {
@@ -101,59 +120,195 @@ func GenerateSchema[T any]() interface{} {
 	return reflector.Reflect(v)
 }
 
-func (p *OpenAIProvider) RequestCompletion(prompt string) (string, error) {
+func (p *OpenAIProvider) RequestCompletion(ctx context.Context, prompt string) (string, error) {
 	log.Debugf("Requesting completion from OpenAI with prompt: %s", prompt)
-	ctx := context.Background()
-	messages := []openai.ChatCompletionMessageParamUnion{}
+	return p.Chat(ctx, ChatRequest{Messages: userMessages(prompt)})
+}
 
-	if p.systemPrompt != "" {
-		messages = append(messages, openai.SystemMessage(p.systemPrompt))
+func (p *OpenAIProvider) RequestCompletionWithJSONSchema(ctx context.Context, prompt string, schema any) (string, error) {
+	res, err := p.Chat(ctx, ChatRequest{Messages: userMessages(prompt), Schema: schema})
+	if err != nil {
+		return "", err
 	}
-	messages = append(messages, openai.UserMessage(prompt))
+	log.Debugf("OpenAI response: %s", res)
 
-	params := openai.ChatCompletionNewParams{
-		Messages: messages,
-		Model:    p.model.Name,
-	}
+	// Return raw JSON, user can unmarshal as needed
+	return res, nil
+}
+
+func (p *OpenAIProvider) StreamCompletion(ctx context.Context, prompt string, onDelta func(string)) (string, error) {
+	log.Debugf("Streaming completion from OpenAI with prompt: %s", prompt)
+	return p.Chat(ctx, ChatRequest{Messages: userMessages(prompt), OnDelta: onDelta})
+}
 
-	resp, err := p.client.Chat.Completions.New(ctx, params)
+func (p *OpenAIProvider) StreamCompletionWithJSONSchema(ctx context.Context, prompt string, schema any, onDelta func(string)) (string, error) {
+	return p.Chat(ctx, ChatRequest{Messages: userMessages(prompt), Schema: schema, OnDelta: onDelta})
+}
+
+// Chat sends the conversation, OpenAI caches long prompt prefixes automatically
+func (p *OpenAIProvider) Chat(ctx context.Context, req ChatRequest) (string, error) {
+	params := p.newParams(ctx, req.Messages)
+	if req.Schema != nil {
+		params.ResponseFormat = jsonSchemaResponseFormat(req.Schema)
+	}
+	if req.OnDelta != nil {
+		return p.streamChatCompletion(ctx, params, req.OnDelta)
+	}
+	resp, err := p.createChatCompletion(ctx, params)
 	if err != nil {
 		return "", err
 	}
 	return resp.Choices[0].Message.Content, nil
 }
 
-func (p *OpenAIProvider) RequestCompletionWithJSONSchema(prompt string, schema any) (string, error) {
-	ctx := context.Background()
-	messages := []openai.ChatCompletionMessageParamUnion{}
-
+func (p *OpenAIProvider) newParams(ctx context.Context, messages []Message) openai.ChatCompletionNewParams {
+	params := openai.ChatCompletionNewParams{Model: p.model.Name}
+	if p.deployment != "" {
+		params.Model = p.deployment
+	}
 	if p.systemPrompt != "" {
-		messages = append(messages, openai.SystemMessage(p.systemPrompt))
+		params.Messages = append(params.Messages, openai.SystemMessage(p.systemPrompt))
+	}
+	for _, m := range messages {
+		params.Messages = append(params.Messages, openAIMessage(m))
 	}
-	messages = append(messages, openai.UserMessage(prompt))
 
+	generation := generationParams(ctx, p.model)
+	if generation.Temperature != nil {
+		params.Temperature = openai.Float(*generation.Temperature)
+	}
+	if generation.TopP != nil {
+		params.TopP = openai.Float(*generation.TopP)
+	}
+	if generation.MaxTokens != nil {
+		params.MaxCompletionTokens = openai.Int(int64(*generation.MaxTokens))
+	}
+	if generation.Seed != nil {
+		params.Seed = openai.Int(*generation.Seed)
+	}
+	if generation.ReasoningEffort != "" {
+		params.ReasoningEffort = shared.ReasoningEffort(generation.ReasoningEffort)
+	}
+	return params
+}
+
+func jsonSchemaResponseFormat(schema any) openai.ChatCompletionNewParamsResponseFormatUnion {
 	schemaParam := openai.ResponseFormatJSONSchemaJSONSchemaParam{
 		Name:   "structured_output",
 		Schema: schema, // expects a struct generated by github.com/invopop/jsonschema
 		Strict: openai.Bool(true),
 	}
-
-	params := openai.ChatCompletionNewParams{
-		Messages: messages,
-		Model:    p.model.Name,
-		ResponseFormat: openai.ChatCompletionNewParamsResponseFormatUnion{
-			OfJSONSchema: &openai.ResponseFormatJSONSchemaParam{
-				JSONSchema: schemaParam,
-			},
+	return openai.ChatCompletionNewParamsResponseFormatUnion{
+		OfJSONSchema: &openai.ResponseFormatJSONSchemaParam{
+			JSONSchema: schemaParam,
 		},
 	}
+}
 
-	resp, err := p.client.Chat.Completions.New(ctx, params)
+func (p *OpenAIProvider) Model() Model {
+	return p.model
+}
+
+// createChatCompletion sends the request with the provider timeout and retry policy
+func (p *OpenAIProvider) createChatCompletion(ctx context.Context, params openai.ChatCompletionNewParams) (*openai.ChatCompletion, error) {
+	resp, err := withRetry(ctx, p.retry, p.timeout, func(ctx context.Context) (*openai.ChatCompletion, error) {
+		return p.client.Chat.Completions.New(ctx, params)
+	})
+	if err != nil {
+		return nil, err
+	}
+	recordCall(ctx, Call{
+		Model: p.model.Name,
+		Usage: Usage{PromptTokens: int(resp.Usage.PromptTokens), CompletionTokens: int(resp.Usage.CompletionTokens)},
+	})
+	if len(resp.Choices) == 0 {
+		return nil, fmt.Errorf("OpenAI returned no choices")
+	}
+	return resp, nil
+}
+
+// streamChatCompletion streams the answer to onDelta, only retrying when nothing was streamed yet
+func (p *OpenAIProvider) streamChatCompletion(ctx context.Context, params openai.ChatCompletionNewParams, onDelta func(string)) (string, error) {
+	params.StreamOptions = openai.ChatCompletionStreamOptionsParam{IncludeUsage: openai.Bool(true)}
+	tracker := &deltaTracker{onDelta: onDelta}
+	var usage Usage
+
+	_, err := withRetry(ctx, p.retry, p.timeout, func(ctx context.Context) (struct{}, error) {
+		stream := p.client.Chat.Completions.NewStreaming(ctx, params)
+		defer stream.Close()
+		for stream.Next() {
+			chunk := stream.Current()
+			if chunk.Usage.TotalTokens > 0 {
+				usage = Usage{PromptTokens: int(chunk.Usage.PromptTokens), CompletionTokens: int(chunk.Usage.CompletionTokens)}
+			}
+			if len(chunk.Choices) > 0 {
+				tracker.emit(chunk.Choices[0].Delta.Content)
+			}
+		}
+		if err := stream.Err(); err != nil {
+			return struct{}{}, tracker.fail(err)
+		}
+		return struct{}{}, nil
+	})
 	if err != nil {
 		return "", err
 	}
-	log.Debugf("OpenAI response: %s", resp.Choices[0].Message.Content)
+	recordCall(ctx, Call{Model: p.model.Name, Usage: usage})
+	return tracker.text.String(), nil
+}
 
-	// Return raw JSON, user can unmarshal as needed
-	return resp.Choices[0].Message.Content, nil
+// RequestToolCalls uses the OpenAI function calling, one call at a time
+func (p *OpenAIProvider) RequestToolCalls(ctx context.Context, messages []Message, tools []Tool) (Message, error) {
+	params := p.newParams(ctx, messages)
+	params.ParallelToolCalls = openai.Bool(false)
+	for _, tool := range tools {
+		parameters, err := schemaToMap(tool.Parameters)
+		if err != nil {
+			return Message{}, err
+		}
+		params.Tools = append(params.Tools, openai.ChatCompletionToolParam{
+			Function: shared.FunctionDefinitionParam{
+				Name:        tool.Name,
+				Description: openai.String(tool.Description),
+				Parameters:  shared.FunctionParameters(parameters),
+			},
+		})
+	}
+
+	resp, err := p.createChatCompletion(ctx, params)
+	if err != nil {
+		return Message{}, err
+	}
+	choice := resp.Choices[0].Message
+	answer := Message{Role: ROLE_ASSISTANT, Content: choice.Content}
+	for _, call := range choice.ToolCalls {
+		answer.ToolCalls = append(answer.ToolCalls, ToolCall{ID: call.ID, Name: call.Function.Name, Arguments: call.Function.Arguments})
+	}
+	return answer, nil
+}
+
+func openAIMessage(m Message) openai.ChatCompletionMessageParamUnion {
+	switch m.Role {
+	case ROLE_ASSISTANT:
+		assistant := openai.ChatCompletionAssistantMessageParam{}
+		if m.Content != "" {
+			assistant.Content.OfString = openai.String(m.Content)
+		}
+		for _, call := range m.ToolCalls {
+			assistant.ToolCalls = append(assistant.ToolCalls, openai.ChatCompletionMessageToolCallParam{
+				ID: call.ID,
+				Function: openai.ChatCompletionMessageToolCallFunctionParam{
+					Name:      call.Name,
+					Arguments: call.Arguments,
+				},
+			})
+		}
+		return openai.ChatCompletionMessageParamUnion{OfAssistant: &assistant}
+	case ROLE_TOOL:
+		return openai.ToolMessage(m.Content, m.ToolCallID)
+	case ROLE_SYSTEM:
+		return openai.SystemMessage(m.Content)
+	default:
+		return openai.UserMessage(m.Content)
+	}
 }
@@ -0,0 +1,120 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Keys of Model.Options read as generation parameters
+const (
+	OPTION_TEMPERATURE      = "temperature"
+	OPTION_TOP_P            = "top_p"
+	OPTION_MAX_TOKENS       = "max_tokens" // Maximum number of tokens of the answer
+	OPTION_SEED             = "seed"
+	OPTION_REASONING_EFFORT = "reasoning_effort" // low, medium or high, for reasoning models
+)
+
+// GenerationParams are the sampling settings sent with a request. Unset fields leave
+// the default of the API, and providers ignore the settings their API does not support.
+type GenerationParams struct {
+	Temperature     *float64
+	TopP            *float64
+	MaxTokens       *int
+	Seed            *int64
+	ReasoningEffort string
+}
+
+// ParseGenerationParams reads the generation parameters of the model options. Unknown
+// keys are left to the provider.
+func ParseGenerationParams(options map[string]string) (GenerationParams, error) {
+	var params GenerationParams
+	for key, value := range options {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		switch strings.ToLower(key) {
+		case OPTION_TEMPERATURE:
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil || v < 0 {
+				return GenerationParams{}, fmt.Errorf("invalid %s %q, expected a positive number", key, value)
+			}
+			params.Temperature = &v
+		case OPTION_TOP_P:
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil || v <= 0 || v > 1 {
+				return GenerationParams{}, fmt.Errorf("invalid %s %q, expected a number between 0 and 1", key, value)
+			}
+			params.TopP = &v
+		case OPTION_MAX_TOKENS:
+			v, err := strconv.Atoi(value)
+			if err != nil || v <= 0 {
+				return GenerationParams{}, fmt.Errorf("invalid %s %q, expected a positive integer", key, value)
+			}
+			params.MaxTokens = &v
+		case OPTION_SEED:
+			v, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return GenerationParams{}, fmt.Errorf("invalid %s %q, expected an integer", key, value)
+			}
+			params.Seed = &v
+		case OPTION_REASONING_EFFORT:
+			switch v := strings.ToLower(value); v {
+			case "low", "medium", "high":
+				params.ReasoningEffort = v
+			default:
+				return GenerationParams{}, fmt.Errorf("invalid %s %q, expected low, medium or high", key, value)
+			}
+		}
+	}
+	return params, nil
+}
+
+// override returns p with the fields set in o replaced
+func (p GenerationParams) override(o GenerationParams) GenerationParams {
+	if o.Temperature != nil {
+		p.Temperature = o.Temperature
+	}
+	if o.TopP != nil {
+		p.TopP = o.TopP
+	}
+	if o.MaxTokens != nil {
+		p.MaxTokens = o.MaxTokens
+	}
+	if o.Seed != nil {
+		p.Seed = o.Seed
+	}
+	if o.ReasoningEffort != "" {
+		p.ReasoningEffort = o.ReasoningEffort
+	}
+	return p
+}
+
+type generationParamsKey struct{}
+
+// WithGenerationParams returns a context whose requests use params, overriding the
+// options of the model for the fields set in params
+func WithGenerationParams(ctx context.Context, params GenerationParams) context.Context {
+	if current, ok := ctx.Value(generationParamsKey{}).(GenerationParams); ok {
+		params = current.override(params)
+	}
+	return context.WithValue(ctx, generationParamsKey{}, params)
+}
+
+// generationParams returns the parameters of a request to the model, the options of the
+// model overridden by the ones of the context
+func generationParams(ctx context.Context, model Model) GenerationParams {
+	params, err := ParseGenerationParams(model.Options)
+	if err != nil {
+		// The profiles are validated when the provider is built
+		log.Warnf("Ignoring the options of model %s: %v", model.Name, err)
+	}
+	if override, ok := ctx.Value(generationParamsKey{}).(GenerationParams); ok {
+		params = params.override(override)
+	}
+	return params
+}
@@ -0,0 +1,152 @@
+package llm
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// ProviderProfile is a named provider configuration, as found in the "providers" config section
+type ProviderProfile struct {
+	Name        string `mapstructure:"-"`
+	Type        string `mapstructure:"type"`         // openai, azure, litellm, anthropic, ollama or llamacpp
+	BaseURL     string `mapstructure:"base_url"`     // API base URL, the endpoint for Azure
+	APIKeyEnv   string `mapstructure:"api_key_env"`  // Name of the environment variable holding the API key
+	APIVersion  string `mapstructure:"api_version"`  // Azure only
+	Deployment  string `mapstructure:"deployment"`   // Azure only, defaults to the model name
+	Model       string `mapstructure:"model"`        // Model name, discovered for local providers when empty
+	ContextSize int    `mapstructure:"context_size"` // Context window in tokens, overrides the known value
+	JSONMode    string `mapstructure:"json_mode"`    // "schema" (default) or "prompt" for models without structured output
+
+	Options map[string]string `mapstructure:"options"` // Model options, such as the generation parameters read by ParseGenerationParams
+}
+
+// ProviderOptions holds the settings shared by every provider
+type ProviderOptions struct {
+	SystemPrompt string
+	Timeout      time.Duration
+	Retry        RetryPolicy
+	JSONRepairs  int // Number of times an invalid JSON answer is sent back to the model
+}
+
+// ResolveModel returns the model of the profile, with the context size of the known
+// model of the same name unless the profile sets one
+func (p ProviderProfile) ResolveModel() Model {
+	if p.Model == "" {
+		return Model{ContextSize: p.ContextSize, Options: p.Options}
+	}
+	model := LookupModel(p.Model)
+	if p.ContextSize > 0 {
+		model.ContextSize = p.ContextSize
+	}
+	model.Options = p.Options
+	return model
+}
+
+func (p ProviderProfile) apiKey() string {
+	if p.APIKeyEnv == "" {
+		return ""
+	}
+	return os.Getenv(p.APIKeyEnv)
+}
+
+// NewProviderFromProfile builds the provider described by the profile. Its JSON answers
+// are validated against the requested schema and repaired when needed.
+func NewProviderFromProfile(profile ProviderProfile, opts ProviderOptions) (Provider, error) {
+	switch profile.JSONMode {
+	case "", JSON_MODE_SCHEMA, JSON_MODE_PROMPT:
+	default:
+		return nil, fmt.Errorf("provider %s: unsupported json_mode %q, supported modes are %s and %s", profile.Name, profile.JSONMode, JSON_MODE_SCHEMA, JSON_MODE_PROMPT)
+	}
+	if _, err := ParseGenerationParams(profile.Options); err != nil {
+		return nil, fmt.Errorf("provider %s: %w", profile.Name, err)
+	}
+	provider, err := newProvider(profile, opts)
+	if err != nil {
+		return nil, err
+	}
+	return NewStructuredOutputProvider(provider, profile.JSONMode, opts.JSONRepairs), nil
+}
+
+func newProvider(profile ProviderProfile, opts ProviderOptions) (Provider, error) {
+	model := profile.ResolveModel()
+	apiKey := profile.apiKey()
+
+	switch profile.Type {
+	case "openai", "litellm":
+		if model.Name == "" {
+			return nil, fmt.Errorf("provider %s: a model is required", profile.Name)
+		}
+		if profile.Type == "litellm" && profile.BaseURL == "" {
+			return nil, fmt.Errorf("provider %s: base_url is required for LiteLLM", profile.Name)
+		}
+		if apiKey == "" {
+			return nil, fmt.Errorf("provider %s: API key is missing, set the %s environment variable", profile.Name, profile.APIKeyEnv)
+		}
+		return NewOpenAIProvider(OpenAIProviderConfig{
+			APIKey:       apiKey,
+			SystemPrompt: opts.SystemPrompt,
+			Model:        model,
+			BaseUrl:      profile.BaseURL,
+			Timeout:      opts.Timeout,
+			Retry:        opts.Retry,
+		}), nil
+	case "azure":
+		if profile.BaseURL == "" {
+			return nil, fmt.Errorf("provider %s: base_url (the Azure OpenAI endpoint) is required", profile.Name)
+		}
+		deployment := profile.Deployment
+		if deployment == "" {
+			deployment = model.Name
+		}
+		if deployment == "" {
+			return nil, fmt.Errorf("provider %s: a deployment or a model is required", profile.Name)
+		}
+		return NewOpenAIProvider(OpenAIProviderConfig{
+			SystemPrompt: opts.SystemPrompt,
+			Model:        model,
+			AzureConfig: &AzureConfig{
+				APIKey:         apiKey, // Falls back to Azure credentials when empty
+				Endpoint:       profile.BaseURL,
+				APIVersion:     profile.APIVersion,
+				DeploymentName: deployment,
+			},
+			Timeout: opts.Timeout,
+			Retry:   opts.Retry,
+		}), nil
+	case "anthropic":
+		if model.Name == "" {
+			return nil, fmt.Errorf("provider %s: a model is required", profile.Name)
+		}
+		if apiKey == "" {
+			return nil, fmt.Errorf("provider %s: API key is missing, set the %s environment variable", profile.Name, profile.APIKeyEnv)
+		}
+		return NewAnthropicProvider(AnthropicProviderConfig{
+			APIKey:       apiKey,
+			SystemPrompt: opts.SystemPrompt,
+			Model:        model,
+			BaseUrl:      profile.BaseURL,
+			Timeout:      opts.Timeout,
+			Retry:        opts.Retry,
+		}), nil
+	case "ollama":
+		return NewOllamaProvider(OllamaProviderConfig{
+			SystemPrompt: opts.SystemPrompt,
+			Model:        model,
+			BaseUrl:      profile.BaseURL,
+			Timeout:      opts.Timeout,
+			Retry:        opts.Retry,
+		}), nil
+	case "llamacpp":
+		return NewLlamaCppProvider(LlamaCppProviderConfig{
+			APIKey:       apiKey,
+			SystemPrompt: opts.SystemPrompt,
+			Model:        model,
+			BaseUrl:      profile.BaseURL,
+			Timeout:      opts.Timeout,
+			Retry:        opts.Retry,
+		}), nil
+	default:
+		return nil, fmt.Errorf("provider %s: unsupported type %q, supported types are openai, azure, litellm, anthropic, ollama and llamacpp", profile.Name, profile.Type)
+	}
+}
@@ -0,0 +1,172 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	openai "github.com/openai/openai-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// RetryPolicy controls how failed LLM requests are retried.
+type RetryPolicy struct {
+	MaxRetries     int           // Number of retries after the first attempt, 0 disables retries
+	InitialBackoff time.Duration // Backoff before the first retry, doubled on each subsequent retry
+	MaxBackoff     time.Duration // Upper bound for the computed backoff and the Retry-After of the server
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries:     3,
+	InitialBackoff: 1 * time.Second,
+	MaxBackoff:     30 * time.Second,
+}
+
+// withRetry calls fn until it succeeds, the error is not retryable, the retries
+// are exhausted or ctx is done. Each attempt gets its own timeout when timeout > 0.
+func withRetry[T any](ctx context.Context, policy RetryPolicy, timeout time.Duration, fn func(ctx context.Context) (T, error)) (T, error) {
+	var zero T
+	for attempt := 0; ; attempt++ {
+		res, err := runAttempt(ctx, timeout, fn)
+		if err == nil {
+			return res, nil
+		}
+		if ctx.Err() != nil {
+			// The caller gave up (e.g. Ctrl-C), do not hide it behind the attempt error
+			return zero, ctx.Err()
+		}
+
+		var interrupted *streamInterruptedError
+		if errors.As(err, &interrupted) {
+			return zero, err
+		}
+
+		retryable, retryAfter := retryInfo(err)
+		if !retryable || attempt >= policy.MaxRetries {
+			return zero, err
+		}
+
+		wait := policy.backoff(attempt)
+		if retryAfter > 0 {
+			// Honor the server, but do not let it stall the session for longer than a backoff
+			wait = min(retryAfter, policy.maxBackoff())
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			// The caller would give up while waiting
+			return zero, err
+		}
+		log.Warnf("LLM request failed (attempt %d/%d): %v, retrying in %s", attempt+1, policy.MaxRetries+1, err, wait.Round(time.Millisecond))
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return zero, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func runAttempt[T any](ctx context.Context, timeout time.Duration, fn func(ctx context.Context) (T, error)) (T, error) {
+	if timeout <= 0 {
+		return fn(ctx)
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return fn(attemptCtx)
+}
+
+// backoff returns an exponential backoff with jitter for the given attempt (0-based)
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.InitialBackoff
+	if backoff <= 0 {
+		backoff = DefaultRetryPolicy.InitialBackoff
+	}
+	for i := 0; i < attempt; i++ {
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff >= p.MaxBackoff {
+			backoff = p.MaxBackoff
+			break
+		}
+	}
+	// Use "equal jitter": half of the backoff is fixed, the other half random
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// maxBackoff returns MaxBackoff, or the default one when unset
+func (p RetryPolicy) maxBackoff() time.Duration {
+	if p.MaxBackoff <= 0 {
+		return DefaultRetryPolicy.MaxBackoff
+	}
+	return p.MaxBackoff
+}
+
+// retryInfo tells whether err is worth retrying and how long the server asked us to wait
+func retryInfo(err error) (bool, time.Duration) {
+	var apiErr *openai.Error
+	if errors.As(err, &apiErr) {
+		var header http.Header
+		if apiErr.Response != nil {
+			header = apiErr.Response.Header
+		}
+		return isRetryableStatus(apiErr.StatusCode), parseRetryAfter(header)
+	}
+	var httpErr *APIError
+	if errors.As(err, &httpErr) {
+		return isRetryableStatus(httpErr.StatusCode), parseRetryAfter(httpErr.Header)
+	}
+
+	// The per-attempt timeout expired while the caller is still waiting
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true, 0
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return true, 0
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true, 0
+	}
+	return false, 0
+}
+
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// parseRetryAfter reads the Retry-After header, either in seconds or as an HTTP date
+func parseRetryAfter(header http.Header) time.Duration {
+	if header == nil {
+		return 0
+	}
+	// OpenAI-compatible gateways sometimes send the more precise retry-after-ms
+	if ms := header.Get("Retry-After-Ms"); ms != "" {
+		if v, err := strconv.ParseFloat(ms, 64); err == nil && v > 0 {
+			return time.Duration(v * float64(time.Millisecond))
+		}
+	}
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		if seconds <= 0 {
+			return 0
+		}
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
@@ -0,0 +1,51 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// rateLimited returns a 429 error asking to retry after the given value of Retry-After
+func rateLimited(retryAfter string) error {
+	return &APIError{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {retryAfter}}}
+}
+
+func TestWithRetryCapsRetryAfter(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 1, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	attempts := 0
+	start := time.Now()
+	res, err := withRetry(context.Background(), policy, 0, func(ctx context.Context) (string, error) {
+		attempts++
+		if attempts == 1 {
+			return "", rateLimited("3600")
+		}
+		return "ok", nil
+	})
+	if err != nil || res != "ok" {
+		t.Fatalf("withRetry returned %q, %v, want ok", res, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waited %s, want at most MaxBackoff", elapsed)
+	}
+}
+
+func TestWithRetryGivesUpBeforeDeadline(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Minute}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	attempts := 0
+	_, err := withRetry(ctx, policy, 0, func(ctx context.Context) (string, error) {
+		attempts++
+		return "", rateLimited("30")
+	})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("withRetry returned %v, want the rate limit error", err)
+	}
+	if attempts != 1 {
+		t.Errorf("made %d attempts, want 1 as the wait exceeds the deadline", attempts)
+	}
+}
@@ -0,0 +1,119 @@
+package llm
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+)
+
+// StreamingProvider is implemented by providers able to stream their answers. onDelta
+// is called with each chunk of text as soon as it is generated, and the full text is
+// returned once the answer is complete.
+type StreamingProvider interface {
+	Provider
+	StreamCompletion(ctx context.Context, prompt string, onDelta func(string)) (string, error)
+	// The deltas are chunks of the raw JSON answer
+	StreamCompletionWithJSONSchema(ctx context.Context, prompt string, schema interface{}, onDelta func(string)) (string, error)
+}
+
+// StreamCompletion streams the answer when the provider supports it, and otherwise
+// calls onDelta once with the full answer
+func StreamCompletion(ctx context.Context, p Provider, prompt string, onDelta func(string)) (string, error) {
+	if sp, ok := p.(StreamingProvider); ok {
+		return sp.StreamCompletion(ctx, prompt, onDelta)
+	}
+	res, err := p.RequestCompletion(ctx, prompt)
+	if err == nil {
+		onDelta(res)
+	}
+	return res, err
+}
+
+// StreamCompletionWithJSONSchema is the structured output counterpart of StreamCompletion
+func StreamCompletionWithJSONSchema(ctx context.Context, p Provider, prompt string, schema interface{}, onDelta func(string)) (string, error) {
+	if sp, ok := p.(StreamingProvider); ok {
+		return sp.StreamCompletionWithJSONSchema(ctx, prompt, schema, onDelta)
+	}
+	res, err := p.RequestCompletionWithJSONSchema(ctx, prompt, schema)
+	if err == nil {
+		onDelta(res)
+	}
+	return res, err
+}
+
+// streamInterruptedError is returned when a stream fails after some text was already
+// handed to the caller, retrying would duplicate that text
+type streamInterruptedError struct {
+	err error
+}
+
+func (e *streamInterruptedError) Error() string {
+	return "stream interrupted: " + e.err.Error()
+}
+
+func (e *streamInterruptedError) Unwrap() error {
+	return e.err
+}
+
+// deltaTracker wraps onDelta to remember whether a delta was emitted
+type deltaTracker struct {
+	onDelta func(string)
+	started bool
+	text    strings.Builder
+}
+
+func (t *deltaTracker) emit(delta string) {
+	if delta == "" {
+		return
+	}
+	t.started = true
+	t.text.WriteString(delta)
+	t.onDelta(delta)
+}
+
+// fail marks err as not retryable when some text was already emitted
+func (t *deltaTracker) fail(err error) error {
+	if t.started {
+		return &streamInterruptedError{err: err}
+	}
+	return err
+}
+
+// readSSE calls onEvent with the event name and data of each server-sent event of r,
+// until r is exhausted or onEvent returns false
+func readSSE(r io.Reader, onEvent func(event string, data string) bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var event string
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if data.Len() > 0 || event != "" {
+				if !onEvent(event, data.String()) {
+					return nil
+				}
+			}
+			event = ""
+			data.Reset()
+		case strings.HasPrefix(line, ":"):
+			// Comment, used as keep-alive
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if data.Len() > 0 {
+		onEvent(event, data.String())
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// JSON_MODE_SCHEMA relies on the structured output support of the API
+	JSON_MODE_SCHEMA = "schema"
+	// JSON_MODE_PROMPT embeds the schema in the prompt, for models without structured output
+	JSON_MODE_PROMPT = "prompt"
+)
+
+// StructuredOutputProvider checks the JSON answers of another provider against the
+// requested schema, and asks the model to fix invalid answers. In JSON_MODE_PROMPT, the
+// schema is sent in the prompt instead of using the structured output of the API.
+type StructuredOutputProvider struct {
+	provider   Provider
+	mode       string
+	maxRepairs int // Number of times an invalid answer is sent back to the model
+}
+
+func NewStructuredOutputProvider(provider Provider, mode string, maxRepairs int) *StructuredOutputProvider {
+	if mode == "" {
+		mode = JSON_MODE_SCHEMA
+	}
+	return &StructuredOutputProvider{provider: provider, mode: mode, maxRepairs: maxRepairs}
+}
+
+func (p *StructuredOutputProvider) RequestCompletion(ctx context.Context, prompt string) (string, error) {
+	return p.provider.RequestCompletion(ctx, prompt)
+}
+
+func (p *StructuredOutputProvider) RequestCompletionWithJSONSchema(ctx context.Context, prompt string, schema any) (string, error) {
+	return p.requestJSON(ctx, ChatRequest{Messages: userMessages(prompt), Schema: schema})
+}
+
+func (p *StructuredOutputProvider) StreamCompletion(ctx context.Context, prompt string, onDelta func(string)) (string, error) {
+	return StreamCompletion(ctx, p.provider, prompt, onDelta)
+}
+
+// StreamCompletionWithJSONSchema only streams the first answer, the repaired ones are not streamed
+func (p *StructuredOutputProvider) StreamCompletionWithJSONSchema(ctx context.Context, prompt string, schema any, onDelta func(string)) (string, error) {
+	return p.requestJSON(ctx, ChatRequest{Messages: userMessages(prompt), Schema: schema, OnDelta: onDelta})
+}
+
+// Chat validates the answer when a schema is requested, like StreamCompletionWithJSONSchema
+func (p *StructuredOutputProvider) Chat(ctx context.Context, req ChatRequest) (string, error) {
+	if req.Schema == nil {
+		return Chat(ctx, p.provider, req)
+	}
+	return p.requestJSON(ctx, req)
+}
+
+func (p *StructuredOutputProvider) Model() Model {
+	return p.provider.Model()
+}
+
+func (p *StructuredOutputProvider) RequestToolCalls(ctx context.Context, messages []Message, tools []Tool) (Message, error) {
+	return RequestToolCalls(ctx, p.provider, messages, tools)
+}
+
+// ListModels lets the discovery of the wrapped provider go through
+func (p *StructuredOutputProvider) ListModels(ctx context.Context) ([]Model, error) {
+	if lister, ok := p.provider.(ModelLister); ok {
+		return lister.ListModels(ctx)
+	}
+	return nil, fmt.Errorf("provider does not support model discovery")
+}
+
+// requestJSON sends the conversation, and sends the invalid answers back to the model
+// as an assistant turn followed by a user turn listing the problems
+func (p *StructuredOutputProvider) requestJSON(ctx context.Context, req ChatRequest) (string, error) {
+	schema := req.Schema
+	messages := append([]Message{}, req.Messages...)
+	if p.mode == JSON_MODE_PROMPT {
+		req.Schema = nil
+		last := len(messages) - 1
+		if last < 0 || messages[last].Role != ROLE_USER {
+			messages = append(messages, Message{Role: ROLE_USER})
+			last++
+		}
+		schemaPrompt, err := promptWithSchema(messages[last].Content, schema)
+		if err != nil {
+			return "", err
+		}
+		messages[last].Content = schemaPrompt
+	}
+
+	var problems []string
+	for attempt := 0; ; attempt++ {
+		req.Messages = messages
+		answer, err := Chat(ctx, p.provider, req)
+		if err != nil {
+			return "", err
+		}
+		req.OnDelta = nil
+
+		var data string
+		data, problems, err = checkJSON(answer, schema)
+		if err != nil {
+			return "", err
+		}
+		if len(problems) == 0 {
+			return data, nil
+		}
+		if attempt >= p.maxRepairs {
+			break
+		}
+		log.Warnf("Invalid JSON answer (attempt %d/%d): %s", attempt+1, p.maxRepairs+1, strings.Join(problems, "; "))
+		messages = append(messages,
+			Message{Role: ROLE_ASSISTANT, Content: answer},
+			Message{Role: ROLE_USER, Content: repairPrompt(problems)},
+		)
+	}
+	return "", fmt.Errorf("invalid JSON answer after %d attempts: %s", p.maxRepairs+1, strings.Join(problems, "; "))
+}
+
+// checkJSON extracts the JSON object of the answer and validates it against the schema
+func checkJSON(answer string, schema any) (string, []string, error) {
+	data, err := ExtractJSON(answer)
+	if err != nil {
+		return "", []string{err.Error()}, nil
+	}
+	problems, err := ValidateJSON(data, schema)
+	if err != nil {
+		return "", nil, err
+	}
+	return data, problems, nil
+}
+
+func promptWithSchema(prompt string, schema any) (string, error) {
+	schemaMap, err := schemaToMap(schema)
+	if err != nil {
+		return "", err
+	}
+	encoded, err := json.MarshalIndent(schemaMap, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode JSON schema: %w", err)
+	}
+	return fmt.Sprintf("%s\n\nAnswer only with a JSON object matching this JSON schema, without any other text:\n```json\n%s\n```", prompt, encoded), nil
+}
+
+func repairPrompt(problems []string) string {
+	var b strings.Builder
+	b.WriteString("Your previous answer does not match the requested JSON schema:\n")
+	for _, problem := range problems {
+		b.WriteString("- " + problem + "\n")
+	}
+	b.WriteString("Answer again with only the corrected JSON object.")
+	return b.String()
+}
@@ -0,0 +1,27 @@
+package llm
+
+import "unicode/utf8"
+
+const (
+	// DEFAULT_CONTEXT_SIZE is assumed for models whose context size is unknown
+	DEFAULT_CONTEXT_SIZE = 32000
+
+	// CHARS_PER_TOKEN is the number of characters counted per token. BPE tokenizers average
+	// ~4 characters per token on English text, but fewer on command outputs full of paths,
+	// numbers, hashes and punctuation.
+	CHARS_PER_TOKEN = 3
+)
+
+// EstimateTokens gives a conservative estimate of the number of tokens of text, so that
+// prompts made of command outputs are more likely overestimated than underestimated
+func EstimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + CHARS_PER_TOKEN - 1) / CHARS_PER_TOKEN
+}
+
+// ContextSizeOrDefault returns the context size of the model, or DEFAULT_CONTEXT_SIZE when unknown
+func (m Model) ContextSizeOrDefault() int {
+	if m.ContextSize > 0 {
+		return m.ContextSize
+	}
+	return DEFAULT_CONTEXT_SIZE
+}
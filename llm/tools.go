@@ -0,0 +1,41 @@
+package llm
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrToolsNotSupported is returned by RequestToolCalls for providers without function calling
+var ErrToolsNotSupported = errors.New("the provider does not support tool calling")
+
+// Tool is a function the model can call
+type Tool struct {
+	Name        string
+	Description string
+	Parameters  any // JSON schema of the arguments, as generated by GenerateSchema
+}
+
+// ToolCall is a call of a tool requested by the model
+type ToolCall struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"` // Raw JSON arguments
+}
+
+// ToolCallingProvider is implemented by providers supporting native function calling.
+// The system prompt of the provider is sent before the messages.
+type ToolCallingProvider interface {
+	Provider
+	// RequestToolCalls returns the next assistant message, which either calls some of
+	// the tools or answers without calling any
+	RequestToolCalls(ctx context.Context, messages []Message, tools []Tool) (Message, error)
+}
+
+// RequestToolCalls sends the conversation to the provider, or returns ErrToolsNotSupported
+func RequestToolCalls(ctx context.Context, p Provider, messages []Message, tools []Tool) (Message, error) {
+	tp, ok := p.(ToolCallingProvider)
+	if !ok {
+		return Message{}, ErrToolsNotSupported
+	}
+	return tp.RequestToolCalls(ctx, messages, tools)
+}
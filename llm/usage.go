@@ -0,0 +1,82 @@
+package llm
+
+import (
+	"context"
+	"sync"
+)
+
+// Usage is the number of tokens consumed by a request
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+}
+
+func (u Usage) Total() int {
+	return u.PromptTokens + u.CompletionTokens
+}
+
+// Call describes a request answered by a provider
+type Call struct {
+	Model    string
+	Provider string // Name of the provider in a FallbackProvider chain, empty otherwise
+	Usage    Usage
+}
+
+// Failover describes a provider of a FallbackProvider chain that failed to answer
+type Failover struct {
+	Provider string
+	Err      error
+}
+
+// CallRecorder collects the calls made with a context returned by WithCallRecorder,
+// so that callers can account for the requests without changing the Provider interface
+type CallRecorder struct {
+	mu        sync.Mutex
+	calls     []Call
+	failovers []Failover
+}
+
+func (r *CallRecorder) Calls() []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Call(nil), r.calls...)
+}
+
+func (r *CallRecorder) Failovers() []Failover {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Failover(nil), r.failovers...)
+}
+
+func (r *CallRecorder) add(call Call) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, call)
+}
+
+type callRecorderKey struct{}
+
+// WithCallRecorder returns a context recording the calls made by the providers into r
+func WithCallRecorder(ctx context.Context, r *CallRecorder) context.Context {
+	return context.WithValue(ctx, callRecorderKey{}, r)
+}
+
+func (r *CallRecorder) addFailover(f Failover) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failovers = append(r.failovers, f)
+}
+
+// recordCall is called by the providers after each successful request
+func recordCall(ctx context.Context, call Call) {
+	if r, ok := ctx.Value(callRecorderKey{}).(*CallRecorder); ok {
+		r.add(call)
+	}
+}
+
+// recordFailover is called by the FallbackProvider when a provider fails
+func recordFailover(ctx context.Context, f Failover) {
+	if r, ok := ctx.Value(callRecorderKey{}).(*CallRecorder); ok {
+		r.addFailover(f)
+	}
+}
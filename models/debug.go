@@ -1,18 +1,68 @@
 package models
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
+	"github.com/remijnoel/ailops/executor"
 	"github.com/remijnoel/ailops/internal"
+	"github.com/remijnoel/ailops/policy"
+	"github.com/remijnoel/ailops/redact"
+)
+
+// Statuses of an action
+const (
+	STATUS_NEW       = "new"
+	STATUS_COMPLETED = "completed" // The command exited with status 0
+	STATUS_FAILED    = "failed"    // The command exited with another status, or could not be run
+	STATUS_TIMEOUT   = "timeout"   // The command was killed after its time limit
+	STATUS_BLOCKED   = "blocked"   // The command restrictions or the policy do not allow the command
+	STATUS_REJECTED  = "rejected"  // The safety review or the user rejected the command, or the tool call is invalid
+	STATUS_DUPLICATE = "duplicate" // The command was already run earlier in the session
 )
 
 type Action struct {
+	ID         string `json:"id"`          // Position of the action in the session, e.g. "2.1" for the first action of the second batch
 	Name       string `json:"name"`        // e.g., could be a command or a description of the action taken
 	ActionType string `json:"action_type"` // e.g., "command" (only type for now)
-	Result     string `json:"result"`      // for a command this would be the output, when pulling data this would be the data pulled, etc.
-	Status     string `json:"status"`      // e.g., "success", "failure", "in-progress"
+	Result     string `json:"result"`      // Why the command did not run or complete, e.g. the reason of a rejection or a connection error
+	Status     string `json:"status"`      // One of the STATUS_* constants
 	Timestamp  string `json:"timestamp"`   // Time when the action was taken
-	Remote     string `json:"remote"`      // Remote host if applicable, e.g., "remote_host_1"
+	Remote     string `json:"remote"`      // Target URI of the remote host, container or pod, if applicable
+
+	Stdout    string        `json:"stdout,omitempty"`
+	Stderr    string        `json:"stderr,omitempty"`
+	ExitCode  int           `json:"exit_code"`            // -1 when the command did not exit normally
+	StartedAt string        `json:"started_at,omitempty"` // RFC 3339 time, with milliseconds
+	Duration  time.Duration `json:"duration,omitempty"`   // Nanoseconds
+	Truncated bool          `json:"truncated,omitempty"`  // The middle of the standard output or error was dropped
+	TimedOut  bool          `json:"timed_out,omitempty"`
+
+	StdoutFile string `json:"stdout_file,omitempty"` // Full standard output, when truncated
+	StderrFile string `json:"stderr_file,omitempty"` // Full standard error, when truncated
+
+	DuplicateOf string `json:"duplicate_of,omitempty"` // ID of the earlier action running the same command
+
+	Review    *SafetyReview `json:"review,omitempty"`    // Verdict of the safety review, when enabled
+	Injection []string      `json:"injection,omitempty"` // Lines of the output that look like instructions to an LLM
+}
+
+// Redaction counts the secrets of a kind replaced by placeholders during a session
+type Redaction struct {
+	Kind        string `json:"kind"`
+	Values      int    `json:"values"`      // Distinct secrets
+	Occurrences int    `json:"occurrences"` // Number of replacements
+}
+
+// SafetyReview is the verdict of the safety review on a command recommended by the model
+type SafetyReview struct {
+	Verdict   string `json:"verdict"`             // "safe", "unsafe" or "needs_review"
+	Reasoning string `json:"reasoning"`           // Why the reviewer reached the verdict
+	Rewrite   string `json:"rewrite,omitempty"`   // Read-only alternative suggested by the reviewer
+	Original  string `json:"original,omitempty"`  // Recommended command, when the rewrite replaced it
+	Confirmed bool   `json:"confirmed,omitempty"` // The user accepted to run a flagged command
+	Model     string `json:"model,omitempty"`     // Model that reviewed the command
 }
 
 func (a *Action) IsCommand() bool {
@@ -20,25 +70,81 @@ func (a *Action) IsCommand() bool {
 	return a.ActionType == "command"
 }
 
+// Ran tells whether the command was run, whatever its outcome
+func (a *Action) Ran() bool {
+	return a.Status == STATUS_COMPLETED || a.Status == STATUS_FAILED || a.Status == STATUS_TIMEOUT
+}
+
+// Output returns the standard output of the command, then its standard error, then why
+// it did not run or complete
+func (a *Action) Output() string {
+	var parts []string
+	for _, part := range []string{a.Stdout, a.Stderr, a.Result} {
+		if part != "" {
+			parts = append(parts, strings.TrimSuffix(part, "\n"))
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// Outcome describes how the command ended, e.g. "exit code 1 after 120ms"
+func (a *Action) Outcome() string {
+	var outcome string
+	switch a.Status {
+	case STATUS_COMPLETED, STATUS_FAILED:
+		if a.ExitCode >= 0 {
+			outcome = fmt.Sprintf("exit code %d after %s", a.ExitCode, a.Duration.Round(time.Millisecond))
+		} else {
+			outcome = fmt.Sprintf("failed after %s", a.Duration.Round(time.Millisecond))
+		}
+	case STATUS_TIMEOUT:
+		outcome = fmt.Sprintf("timed out after %s", a.Duration.Round(time.Second))
+	case STATUS_BLOCKED:
+		return "blocked by the command restrictions"
+	case STATUS_REJECTED:
+		return "rejected"
+	case STATUS_DUPLICATE:
+		return "not run again, same command as an earlier one"
+	default:
+		return "not run"
+	}
+	if a.Truncated {
+		outcome += ", output truncated"
+	}
+	return outcome
+}
+
 func (a *Action) IsRemote() bool {
 	// Check if the action is remote by checking if Remote is set
 	return a.Remote != ""
 }
 
 type Batch struct {
-	Description string    `json:"description"` // The reason for the batch, e.g., "Debugging issue with X"
-	Actions     []*Action `json:"actions"`     // List of actions in this batch
-	Analysis    string    `json:"analysis"`    // Analysis of the batch actions
-	NextSteps   []string  `json:"next_steps"`  // Suggested next steps after this batch
-	Completed   bool      `json:"completed"`   // Indicates if the batch has been completed
+	Description string     `json:"description"`         // The reason for the batch, e.g., "Debugging issue with X"
+	Actions     []*Action  `json:"actions"`             // List of actions in this batch
+	Analysis    string     `json:"analysis"`            // Analysis of the batch actions
+	NextSteps   []string   `json:"next_steps"`          // Suggested next steps after this batch
+	Completed   bool       `json:"completed"`           // Indicates if the batch has been completed
+	Model       string     `json:"model"`               // Model that produced the analysis
+	Provider    string     `json:"provider,omitempty"`  // Provider that produced the analysis, when fallback providers are configured
+	Failovers   []Failover `json:"failovers,omitempty"` // Providers that failed to analyze the batch
+	Usage       TokenUsage `json:"usage"`               // Tokens consumed to analyze the batch
+
+	InjectionSuspected bool `json:"injection_suspected,omitempty"` // An output of the batch looks like a prompt injection
+}
+
+// Failover records a provider that failed to answer, before falling back to the next one
+type Failover struct {
+	Provider string `json:"provider"`
+	Error    string `json:"error"`
 }
 
 func (b *Batch) AddAction(name string, actionType string) *Action {
 	action := &Action{
 		Name:       name,
 		ActionType: actionType,
-		Status:     "new", // Default status is "new"
-		Result:     "",    // Initially empty, will be filled after execution
+		Status:     STATUS_NEW,
+		Result:     "", // Initially empty, will be filled after execution
 	}
 	b.Actions = append(b.Actions, action)
 
@@ -46,22 +152,61 @@ func (b *Batch) AddAction(name string, actionType string) *Action {
 }
 
 type DebugSessionConfig struct {
-	FirstCommands []string `json:"first_commands"` // Initial commands to run for debugging
-	Remote        string   `json:"remote"`         // Remote host to run commands on, if applicable
-	UseSudo       bool     `json:"use_sudo"`       // Whether to use sudo for commands
-	CommandWhitelist []string `json:"command_whitelist"` // List of allowed commands for security
-	CommandBlacklist  []string `json:"command_blacklist"`  // List of disallowed commands for security
+	FirstCommands         []string     `json:"first_commands"`          // Initial commands to run for debugging
+	Remote                string       `json:"remote"`                  // Target URI the commands run on, e.g. "ssh://root@web-1:22"
+	UseSudo               bool         `json:"use_sudo"`                // Whether to use sudo for commands
+	CommandWhitelist      []string     `json:"command_whitelist"`       // List of allowed commands for security
+	CommandBlacklist      []string     `json:"command_blacklist"`       // List of disallowed commands for security
+	ModelPricing          []ModelPrice `json:"model_pricing"`           // Prices used to estimate the cost of the session
+	MaxTokensPerSession   int          `json:"max_tokens_per_session"`  // Stop investigating once reached, 0 means no limit
+	MaxCostPerSession     float64      `json:"max_cost_per_session"`    // Stop investigating once reached (USD), 0 means no limit
+	ContextBudgetFraction float64      `json:"context_budget_fraction"` // Share of the model context the analysis prompt may use
+	InvestigationMode     string       `json:"investigation_mode"`      // "batch" (default) or "tools"
+	MaxToolSteps          int          `json:"max_tool_steps"`          // Maximum number of tool calling steps in the tools mode
+	SafetyReview          bool         `json:"safety_review"`           // Review the recommended commands with a second LLM call before running them
+	UnsafeCommands        string       `json:"unsafe_commands"`         // "reject" (default) or "confirm" the unsafe commands without a rewrite
+
+	AllowedMutatingCommands []string `json:"allowed_mutating_commands"` // Programs or subcommands altering the host allowed anyway, e.g. "systemctl restart"
+	AllowOutputRedirects    bool     `json:"allow_output_redirects"`    // Allow the commands to redirect their output to files
+	Environment             string   `json:"environment"`               // Environment of the host, matched by the scopes of the policy rules
+
+	Policy   *policy.Policy    `json:"-"` // Allow and deny rules of the policy file, nil when there is none
+	Executor executor.Executor `json:"-"` // Runs the commands on the target of the session, nil runs them locally
+
+	DisableInjectionDetection bool `json:"disable_injection_detection"` // Do not look for prompt injections in the command outputs
+
+	Redactor *redact.Redactor `json:"-"` // Replaces the secrets of the command outputs, nil disables the redaction
+
+	OutputLimits executor.Limits `json:"output_limits"`          // Part of the outputs kept by default, executor.DefaultLimits when zero
+	OutputRules  []OutputRule    `json:"output_rules,omitempty"` // Limits of the commands starting with a pattern, the first match wins
+	SpillDir     string          `json:"spill_dir,omitempty"`    // Directory receiving the full outputs of the truncated commands, none when empty
+}
+
+// OutputRule sets the part of the outputs kept for the commands starting with a pattern
+type OutputRule struct {
+	Pattern   string `json:"pattern" mapstructure:"pattern"` // Start of the command, e.g. "journalctl" or "kubectl logs"
+	HeadBytes int    `json:"head_bytes" mapstructure:"head_bytes"`
+	TailBytes int    `json:"tail_bytes" mapstructure:"tail_bytes"`
 }
 
 type DebugSessionLog struct {
-	ID               string              `json:"id"`
-	IssueDescription string              `json:"issue_description"`
-	Batches          []*Batch            `json:"batches"`
-	StartTime        string              `json:"start_time"`
-	EndTime          string              `json:"end_time"`
-	Summary          string              `json:"summary"`
-	Diagnosed        bool                `json:"ended"`
-	Config           *DebugSessionConfig `json:"config"` // Configuration for the workflow
+	ID                 string              `json:"id"`
+	IssueDescription   string              `json:"issue_description"`
+	Batches            []*Batch            `json:"batches"`
+	StartTime          string              `json:"start_time"`
+	EndTime            string              `json:"end_time"`
+	Summary            string              `json:"summary"`
+	SummaryModel       string              `json:"summary_model"`               // Model that produced the summary
+	SummaryProvider    string              `json:"summary_provider,omitempty"`  // Provider that produced the summary, when fallback providers are configured
+	SummaryFailovers   []Failover          `json:"summary_failovers,omitempty"` // Providers that failed to produce the summary
+	Usage              TokenUsage          `json:"usage"`                       // Tokens consumed by the whole session
+	HistorySummary     string              `json:"history_summary,omitempty"`   // Summary replacing the first SummarizedBatches batches in the prompts
+	SummarizedBatches  int                 `json:"summarized_batches"`          // Number of batches covered by HistorySummary
+	StoppedByBudget    bool                `json:"stopped_by_budget"`           // The investigation ended because the budget was exceeded
+	Redactions         []Redaction         `json:"redactions,omitempty"`        // Secrets replaced by placeholders in the command outputs
+	StoppedByInjection bool                `json:"stopped_by_injection"`        // The investigation ended because an output looked like a prompt injection and nobody could confirm the next commands
+	Diagnosed          bool                `json:"ended"`
+	Config             *DebugSessionConfig `json:"config"` // Configuration for the workflow
 }
 
 func (d *DebugSessionLog) SetIssueDescription(description string) {
@@ -76,11 +221,17 @@ func (d *DebugSessionLog) EndSession() {
 	d.EndTime = time.Now().Format(time.RFC3339)
 }
 
+// AddBatch appends the batch to the session, and gives an ID to its actions
 func (d *DebugSessionLog) AddBatch(batch *Batch) {
 	if d.Batches == nil {
 		d.Batches = []*Batch{}
 	}
 	d.Batches = append(d.Batches, batch)
+	for i, action := range batch.Actions {
+		if action.ID == "" {
+			action.ID = fmt.Sprintf("%d.%d", len(d.Batches), i+1)
+		}
+	}
 }
 
 func (d *DebugSessionLog) LastBatch() *Batch {
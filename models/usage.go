@@ -0,0 +1,51 @@
+package models
+
+// TokenUsage is the number of tokens consumed by LLM calls and their estimated cost
+type TokenUsage struct {
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	Cost             float64 `json:"cost"` // In USD, only counts the models with a configured price
+	Calls            int     `json:"calls"`
+}
+
+func (u *TokenUsage) Add(other TokenUsage) {
+	u.PromptTokens += other.PromptTokens
+	u.CompletionTokens += other.CompletionTokens
+	u.Cost += other.Cost
+	u.Calls += other.Calls
+}
+
+func (u TokenUsage) TotalTokens() int {
+	return u.PromptTokens + u.CompletionTokens
+}
+
+// ModelPrice is the price of a model in USD per million tokens
+type ModelPrice struct {
+	Model            string  `json:"model" mapstructure:"model"`
+	InputPerMillion  float64 `json:"input_per_million" mapstructure:"input_per_million"`
+	OutputPerMillion float64 `json:"output_per_million" mapstructure:"output_per_million"`
+}
+
+// Cost returns the cost of the tokens for the model, 0 when it has no configured price
+func (c *DebugSessionConfig) Cost(model string, promptTokens int, completionTokens int) float64 {
+	for _, price := range c.ModelPricing {
+		if price.Model == model {
+			return (float64(promptTokens)*price.InputPerMillion + float64(completionTokens)*price.OutputPerMillion) / 1e6
+		}
+	}
+	return 0
+}
+
+// BudgetExceeded tells whether the session used more tokens or money than allowed
+func (d *DebugSessionLog) BudgetExceeded() bool {
+	if d.Config == nil {
+		return false
+	}
+	if d.Config.MaxTokensPerSession > 0 && d.Usage.TotalTokens() >= d.Config.MaxTokensPerSession {
+		return true
+	}
+	if d.Config.MaxCostPerSession > 0 && d.Usage.Cost >= d.Config.MaxCostPerSession {
+		return true
+	}
+	return false
+}
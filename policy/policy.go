@@ -0,0 +1,266 @@
+// Package policy evaluates the commands recommended by the LLM against a declarative
+// policy file of allow and deny rules.
+package policy
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ACTION_ALLOW = "allow"
+	ACTION_DENY  = "deny"
+)
+
+// Policy is a list of rules evaluated in order, the first rule matching a command decides
+// whether it is allowed. The default action applies when no rule matches.
+type Policy struct {
+	Default string  `yaml:"default"` // "allow" or "deny" (default)
+	Rules   []*Rule `yaml:"rules"`
+}
+
+// Rule matches a simple command, i.e. a program and its arguments without the wrappers
+// such as sudo. Every condition set must hold for the rule to match.
+type Rule struct {
+	Name         string   `yaml:"name"`
+	Action       string   `yaml:"action"`       // "allow" or "deny"
+	Program      string   `yaml:"program"`      // Glob on the name of the program, e.g. "systemctl" or "*ctl"
+	Args         string   `yaml:"args"`         // Glob on the arguments joined by spaces, e.g. "status *"
+	ArgsRegex    string   `yaml:"args_regex"`   // Regular expression on the arguments joined by spaces
+	Paths        []string `yaml:"paths"`        // Directories or globs the arguments must be under, every argument that is not an option being a path
+	Hosts        []string `yaml:"hosts"`        // Globs on the host the command runs on, "local" for the local host
+	Environments []string `yaml:"environments"` // Globs on the environment of the session, e.g. "prod*"
+	Mutating     bool     `yaml:"mutating"`     // An allow rule also permits the command to alter the host
+
+	program   *regexp.Regexp
+	args      *regexp.Regexp
+	argsRegex *regexp.Regexp
+}
+
+// Scope is where a command runs, matched against the hosts and environments of the rules
+type Scope struct {
+	Host        string
+	Environment string
+}
+
+// Decision is the result of the evaluation of a command
+type Decision struct {
+	Action string
+	Rule   *Rule // nil when the default action applies
+	Index  int   // Position of the rule in the policy, starting at 1
+}
+
+func (d Decision) String() string {
+	if d.Rule == nil {
+		return "the default action (" + d.Action + ")"
+	}
+	return d.Rule.String()
+}
+
+func (r *Rule) String() string {
+	if r.Name != "" {
+		return fmt.Sprintf("rule %q", r.Name)
+	}
+	return fmt.Sprintf("rule %s %s", r.Action, r.Program)
+}
+
+// Load reads and validates a policy file
+func Load(file string) (*Policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading policy file: %w", err)
+	}
+	p, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", file, err)
+	}
+	return p, nil
+}
+
+// Parse decodes and validates a policy in YAML
+func Parse(data []byte) (*Policy, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	var p Policy
+	if err := decoder.Decode(&p); err != nil {
+		return nil, err
+	}
+	if p.Default == "" {
+		p.Default = ACTION_DENY
+	}
+	if p.Default != ACTION_ALLOW && p.Default != ACTION_DENY {
+		return nil, fmt.Errorf("invalid default action %q, supported actions are %s and %s", p.Default, ACTION_ALLOW, ACTION_DENY)
+	}
+	for i, r := range p.Rules {
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+	return &p, nil
+}
+
+func (r *Rule) compile() error {
+	if r.Action != ACTION_ALLOW && r.Action != ACTION_DENY {
+		return fmt.Errorf("invalid action %q, supported actions are %s and %s", r.Action, ACTION_ALLOW, ACTION_DENY)
+	}
+	if r.Program == "" {
+		return fmt.Errorf("a program is required, use \"*\" to match every program")
+	}
+	if r.Mutating && r.Action != ACTION_ALLOW {
+		return fmt.Errorf("mutating only applies to allow rules")
+	}
+	r.program = globPattern(r.Program)
+	if r.Args != "" {
+		r.args = globPattern(r.Args)
+	}
+	if r.ArgsRegex != "" {
+		var err error
+		if r.argsRegex, err = regexp.Compile(r.ArgsRegex); err != nil {
+			return fmt.Errorf("invalid args_regex: %w", err)
+		}
+	}
+	for _, p := range r.Paths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("path %q is not absolute", p)
+		}
+	}
+	return nil
+}
+
+// Evaluate returns the decision of the policy on a program and its arguments
+func (p *Policy) Evaluate(args []string, scope Scope) Decision {
+	for i, r := range p.Rules {
+		if r.Matches(args, scope) {
+			return Decision{Action: r.Action, Rule: r, Index: i + 1}
+		}
+	}
+	return Decision{Action: p.Default}
+}
+
+// Matches tells whether the rule applies to the program and its arguments in the scope
+func (r *Rule) Matches(args []string, scope Scope) bool {
+	if len(args) == 0 || !r.program.MatchString(path.Base(args[0])) {
+		return false
+	}
+	if len(r.Hosts) > 0 && !matchesAny(r.Hosts, scope.Host) {
+		return false
+	}
+	if len(r.Environments) > 0 && !matchesAny(r.Environments, scope.Environment) {
+		return false
+	}
+	joined := strings.Join(args[1:], " ")
+	if r.args != nil && !r.args.MatchString(joined) {
+		return false
+	}
+	if r.argsRegex != nil && !r.argsRegex.MatchString(joined) {
+		return false
+	}
+	if len(r.Paths) > 0 && !r.matchesPaths(pathArguments(args[1:])) {
+		return false
+	}
+	return true
+}
+
+// matchesPaths tells whether the paths of a command meet the paths of the rule. As the
+// working directory of the command is not known, a relative path or a command without
+// paths is outside the directories: an allow rule needs every path under them, and a deny
+// rule matches as soon as one path is not known to be outside them.
+func (r *Rule) matchesPaths(paths []string) bool {
+	if r.Action == ACTION_DENY {
+		if len(paths) == 0 {
+			return true
+		}
+		for _, p := range paths {
+			if !strings.HasPrefix(p, "/") || underAny(r.Paths, p) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(paths) == 0 {
+		return false
+	}
+	for _, p := range paths {
+		if !underAny(r.Paths, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// pathArguments returns the files named by the arguments: every argument that is not an
+// option, every argument after "--", and the value of options such as "--file=/etc/x"
+func pathArguments(args []string) []string {
+	var paths []string
+	options := true
+	for _, arg := range args {
+		switch {
+		case options && arg == "--":
+			options = false
+		case options && strings.HasPrefix(arg, "-") && arg != "-":
+			if _, value, ok := strings.Cut(arg, "="); ok {
+				paths = append(paths, value)
+			}
+		default:
+			paths = append(paths, arg)
+		}
+	}
+	return paths
+}
+
+// underAny tells whether the path is one of the directories or under one of them, or
+// matches one of the globs. Relative paths never match, as the working directory of the
+// command is not known.
+func underAny(patterns []string, p string) bool {
+	if !strings.HasPrefix(p, "/") {
+		return false
+	}
+	p = path.Clean(p)
+	for _, pattern := range patterns {
+		if strings.ContainsAny(pattern, "*?") {
+			if globPattern(pattern).MatchString(p) {
+				return true
+			}
+			continue
+		}
+		dir := path.Clean(pattern)
+		if p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAny(globs []string, s string) bool {
+	for _, glob := range globs {
+		if globPattern(glob).MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// globPattern converts a glob to a regular expression matching the whole string, where
+// "*" matches any sequence of characters, slashes and spaces included, and "?" any character
+func globPattern(glob string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, c := range glob {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
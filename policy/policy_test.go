@@ -0,0 +1,132 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+)
+
+const testPolicy = `
+default: deny
+rules:
+  - name: no-restarts-in-prod
+    action: deny
+    program: systemctl
+    args: "restart *"
+    environments: ["prod*"]
+  - name: status
+    action: allow
+    program: systemctl
+    args: "status*"
+  - name: restarts
+    action: allow
+    program: systemctl
+    args_regex: '^restart [a-z-]+$'
+    hosts: ["web-*"]
+    mutating: true
+  - name: no-secrets
+    action: deny
+    program: cat
+    paths: [/etc/shadow, /root]
+  - name: logs
+    action: allow
+    program: cat
+    paths: [/var/log, /etc/*.conf]
+  - name: local-ctl
+    action: allow
+    program: "*ctl"
+    hosts: [local]
+`
+
+func TestEvaluate(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	web := Scope{Host: "web-1", Environment: "staging"}
+	tests := []struct {
+		command string
+		scope   Scope
+		action  string
+		index   int // Rule deciding, 0 for the default action
+	}{
+		// Globs, regular expressions and scopes
+		{"systemctl restart nginx", Scope{Host: "web-1", Environment: "prod-eu"}, ACTION_DENY, 1},
+		{"systemctl restart nginx", web, ACTION_ALLOW, 3},
+		{"systemctl restart nginx", Scope{Host: "db-1", Environment: "staging"}, ACTION_DENY, 0},
+		{"systemctl restart Nginx", web, ACTION_DENY, 0},
+		{"systemctl status nginx", Scope{Host: "db-1", Environment: "prod"}, ACTION_ALLOW, 2},
+		{"/usr/bin/systemctl status", web, ACTION_ALLOW, 2},
+		{"journalctl -u nginx", Scope{Host: "local"}, ACTION_ALLOW, 6},
+		{"journalctl -u nginx", web, ACTION_DENY, 0},
+
+		// Paths
+		{"cat /var/log/syslog", web, ACTION_ALLOW, 5},
+		{"cat -n /var/log/syslog /var/log/auth.log", web, ACTION_ALLOW, 5},
+		{"cat /etc/nginx.conf", web, ACTION_ALLOW, 5},
+		{"cat /etc/shadow", web, ACTION_DENY, 4},
+		{"cat /var/log/../../etc/shadow", web, ACTION_DENY, 4},
+		{"cat /root/.ssh/id_rsa", web, ACTION_DENY, 4},
+		{"cat /var/log/syslog /etc/passwd", web, ACTION_DENY, 0},
+		{"cat /var/logs/syslog", web, ACTION_DENY, 0},
+		// Relative paths and commands without paths are not known to be outside the directories
+		{"cat shadow", web, ACTION_DENY, 4},
+		{"cat ../../etc/shadow", web, ACTION_DENY, 4},
+		{"cat", web, ACTION_DENY, 4},
+		// The values of --opt=value are paths, and every argument after --
+		{"cat --file=/root/x", web, ACTION_DENY, 4},
+		{"cat --file=/var/log/syslog", web, ACTION_ALLOW, 5},
+		{"cat -- -n", web, ACTION_DENY, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			d := p.Evaluate(strings.Fields(tt.command), tt.scope)
+			if d.Action != tt.action || d.Index != tt.index {
+				t.Errorf("Evaluate(%q, %+v) = %s by %s (#%d), want %s (#%d)", tt.command, tt.scope, d.Action, d, d.Index, tt.action, tt.index)
+			}
+			if (d.Rule == nil) != (tt.index == 0) {
+				t.Errorf("Evaluate(%q) returned the rule %v, want rule #%d", tt.command, d.Rule, tt.index)
+			}
+		})
+	}
+}
+
+func TestEvaluateDefault(t *testing.T) {
+	tests := []struct {
+		policy string
+		action string
+	}{
+		{"rules: []", ACTION_DENY},
+		{"default: deny", ACTION_DENY},
+		{"default: allow", ACTION_ALLOW},
+	}
+	for _, tt := range tests {
+		p, err := Parse([]byte(tt.policy))
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", tt.policy, err)
+		}
+		if d := p.Evaluate([]string{"ls"}, Scope{}); d.Action != tt.action || d.Rule != nil {
+			t.Errorf("Evaluate with %q = %s by %s, want the default action %s", tt.policy, d.Action, d, tt.action)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		policy string
+		err    string
+	}{
+		{"default: maybe", "invalid default action"},
+		{"rules: [{action: block, program: ls}]", "invalid action"},
+		{"rules: [{action: allow}]", "a program is required"},
+		{"rules: [{action: allow, program: cat, paths: [var/log]}]", "is not absolute"},
+		{"rules: [{action: allow, program: ls, args_regex: '('}]", "invalid args_regex"},
+		{"rules: [{action: deny, program: rm, mutating: true}]", "mutating only applies to allow rules"},
+		{"rules: [{action: allow, program: ls, arguments: -la}]", "not found"},
+	}
+	for _, tt := range tests {
+		_, err := Parse([]byte(tt.policy))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Parse(%q) returned %v, want an error containing %q", tt.policy, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// Package redact replaces the secrets found in command outputs by placeholders before
+// they are sent to an LLM or written to a report.
+package redact
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	MIN_HIGH_ENTROPY_LENGTH = 24  // Shorter strings are not checked for entropy
+	MIN_HIGH_ENTROPY        = 4.0 // Shannon entropy in bits per character
+)
+
+// Rule is a pattern of secrets. When the pattern has a capture group, only the first
+// group is redacted, so that the context of the secret (e.g. "password=") is kept.
+type Rule struct {
+	Name    string `mapstructure:"name"`
+	Pattern string `mapstructure:"pattern"`
+}
+
+// BuiltinRules are the detectors of the well-known secret formats, applied in order
+var BuiltinRules = []Rule{
+	{Name: "private_key", Pattern: `-----BEGIN [A-Z ]*PRIVATE KEY(?: BLOCK)?-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY(?: BLOCK)?-----`},
+	// Parts of a key cut by a truncation: a BEGIN line without END and the lines that follow
+	// it, or the lines preceding an END line without BEGIN
+	{Name: "private_key", Pattern: `-----BEGIN [A-Z ]*PRIVATE KEY(?: BLOCK)?-----(?:\r?\n(?:[A-Za-z0-9+/=]+|[A-Za-z-]+: .*)?)*`},
+	{Name: "private_key", Pattern: `(?m)(?:^[A-Za-z0-9+/=]+\r?\n)*-----END [A-Z ]*PRIVATE KEY(?: BLOCK)?-----`},
+	{Name: "aws_access_key", Pattern: `\b((?:AKIA|ASIA|AIDA|AROA)[0-9A-Z]{16})\b`},
+	{Name: "aws_secret_key", Pattern: `(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})`},
+	{Name: "jwt", Pattern: `\beyJ[A-Za-z0-9_-]{8,}\.eyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,}`},
+	{Name: "github_token", Pattern: `\b(gh[pousr]_[A-Za-z0-9]{36,})\b`},
+	{Name: "slack_token", Pattern: `\b(xox[abposr]-[A-Za-z0-9-]{10,})\b`},
+	{Name: "bearer_token", Pattern: `(?i)\bbearer\s+([A-Za-z0-9._~+/-]{16,}=*)`},
+	{Name: "connection_string", Pattern: `\b[a-zA-Z][a-zA-Z0-9+.-]*://[^\s:/@]+:([^\s@/]+)@`},
+	{Name: "password", Pattern: `(?i)(?:^|\s)--?(?:password|passwd|pass|token|secret|api-?key)(?:=|\s+)["']?([^\s"']{4,})`},
+	{Name: "password", Pattern: `(?i)\b[a-z0-9_.-]*(?:password|passwd|pwd|secret|token|api_?key|access_?key|credentials?)["']?\s*[:=]\s*["']?([^\s"',;]{4,})`},
+}
+
+type rule struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+// Finding counts the secrets of a kind that were redacted
+type Finding struct {
+	Kind        string
+	Values      int // Distinct secrets
+	Occurrences int
+}
+
+// Redactor replaces secrets by placeholders such as [REDACTED_PASSWORD_1]. A secret is
+// always replaced by the same placeholder, so that the LLM can still correlate outputs.
+type Redactor struct {
+	mu           sync.Mutex
+	rules        []rule
+	highEntropy  bool
+	placeholders map[string]string // Secret to placeholder
+	values       map[string]int    // Distinct secrets per kind
+	occurrences  map[string]int    // Occurrences per kind
+}
+
+// New returns a redactor applying the built-in rules, then the custom ones, and finally
+// replacing the high-entropy strings when highEntropy is set
+func New(custom []Rule, highEntropy bool) (*Redactor, error) {
+	r := &Redactor{
+		highEntropy:  highEntropy,
+		placeholders: map[string]string{},
+		values:       map[string]int{},
+		occurrences:  map[string]int{},
+	}
+	for _, ru := range append(append([]Rule{}, BuiltinRules...), custom...) {
+		if ru.Name == "" || ru.Pattern == "" {
+			return nil, fmt.Errorf("redaction rule %q: a name and a pattern are required", ru.Name)
+		}
+		pattern, err := regexp.Compile(ru.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("redaction rule %q: %w", ru.Name, err)
+		}
+		r.rules = append(r.rules, rule{name: ru.Name, pattern: pattern})
+	}
+	return r, nil
+}
+
+// Redact returns s with its secrets replaced by placeholders
+func (r *Redactor) Redact(s string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, ru := range r.rules {
+		s = r.replace(s, ru)
+	}
+	if r.highEntropy {
+		s = highEntropyCandidate.ReplaceAllStringFunc(s, func(candidate string) string {
+			if isPlaceholder(candidate) || !isHighEntropy(candidate) {
+				return candidate
+			}
+			return r.placeholder("high_entropy", candidate)
+		})
+	}
+	return s
+}
+
+// Findings returns the number of secrets redacted so far, by kind
+func (r *Redactor) Findings() []Finding {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	findings := make([]Finding, 0, len(r.occurrences))
+	for kind, occurrences := range r.occurrences {
+		findings = append(findings, Finding{Kind: kind, Values: r.values[kind], Occurrences: occurrences})
+	}
+	sort.Slice(findings, func(i, j int) bool { return findings[i].Kind < findings[j].Kind })
+	return findings
+}
+
+func (r *Redactor) replace(s string, ru rule) string {
+	matches := ru.pattern.FindAllStringSubmatchIndex(s, -1)
+	if len(matches) == 0 {
+		return s
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		// Redact the first capture group when there is one, the whole match otherwise
+		start, end := m[0], m[1]
+		if len(m) >= 4 && m[2] >= 0 {
+			start, end = m[2], m[3]
+		}
+		if start < last || isPlaceholder(s[start:end]) {
+			continue
+		}
+		b.WriteString(s[last:start])
+		b.WriteString(r.placeholder(ru.name, s[start:end]))
+		last = end
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+func (r *Redactor) placeholder(kind string, secret string) string {
+	r.occurrences[kind]++
+	if p, ok := r.placeholders[secret]; ok {
+		return p
+	}
+	r.values[kind]++
+	p := fmt.Sprintf("[REDACTED_%s_%d]", strings.ToUpper(kind), r.values[kind])
+	r.placeholders[secret] = p
+	return p
+}
+
+var highEntropyCandidate = regexp.MustCompile(`[A-Za-z0-9+=_-]{` + fmt.Sprint(MIN_HIGH_ENTROPY_LENGTH) + `,}`)
+
+var placeholderPattern = regexp.MustCompile(`^\[?REDACTED_[A-Z0-9_]+_\d+\]?$`)
+
+func isPlaceholder(s string) bool {
+	return placeholderPattern.MatchString(s)
+}
+
+// isHighEntropy tells whether s looks like a random token: mixed case letters and digits
+// with a high entropy. Hexadecimal hashes and identifiers are kept, as their entropy is
+// at most 4 bits per character and they help the diagnosis.
+func isHighEntropy(s string) bool {
+	var upper, lower, digit bool
+	for _, c := range s {
+		switch {
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsDigit(c):
+			digit = true
+		}
+	}
+	return upper && lower && digit && entropy(s) > MIN_HIGH_ENTROPY
+}
+
+func entropy(s string) float64 {
+	counts := map[rune]int{}
+	for _, c := range s {
+		counts[c]++
+	}
+	var h float64
+	n := float64(len(s))
+	for _, count := range counts {
+		p := float64(count) / n
+		h -= p * math.Log2(p)
+	}
+	return h
+}
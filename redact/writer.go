@@ -0,0 +1,98 @@
+package redact
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+)
+
+const (
+	MAX_LINE_LENGTH = 64 * 1024 // Longer lines are redacted in pieces
+	MAX_KEY_LENGTH  = 64 * 1024 // Private keys are held until their END line up to this size
+)
+
+var (
+	keyBegin = regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY(?: BLOCK)?-----`)
+	keyEnd   = regexp.MustCompile(`-----END [A-Z ]*PRIVATE KEY(?: BLOCK)?-----`)
+)
+
+// Writer redacts a stream before writing it to the underlying writer. The stream is
+// redacted line by line, except for private keys whose lines are held until their END
+// line, so that the whole key is redacted.
+type Writer struct {
+	r     *Redactor
+	w     io.Writer
+	buf   []byte // Incomplete line, or the lines of a private key
+	inKey bool   // buf starts with the BEGIN line of a private key
+	err   error
+}
+
+// NewWriter returns a writer redacting what is written to it before writing it to w.
+// Close must be called at the end of the stream to write the last line.
+func (r *Redactor) NewWriter(w io.Writer) *Writer {
+	return &Writer{r: r, w: w}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	w.process(false)
+	return len(p), w.err
+}
+
+// Close writes the rest of the stream, without closing the underlying writer
+func (w *Writer) Close() error {
+	w.process(true)
+	return w.err
+}
+
+// process writes the complete lines of the buffer, or all of it when closing
+func (w *Writer) process(closing bool) {
+	for w.err == nil && len(w.buf) > 0 {
+		if w.inKey {
+			if loc := keyEnd.FindIndex(w.buf); loc != nil {
+				end := len(w.buf)
+				if i := bytes.IndexByte(w.buf[loc[1]:], '\n'); i >= 0 {
+					end = loc[1] + i + 1
+				} else if !closing {
+					return
+				}
+				w.flush(end)
+				w.inKey = false
+				continue
+			}
+			if !closing && len(w.buf) <= MAX_KEY_LENGTH {
+				return
+			}
+			// The key without its END line is redacted by the rule of unterminated keys
+			w.flush(len(w.buf))
+			w.inKey = false
+			continue
+		}
+
+		end := bytes.LastIndexByte(w.buf, '\n') + 1
+		if closing || end == 0 && len(w.buf) > MAX_LINE_LENGTH {
+			end = len(w.buf)
+		}
+		if loc := keyBegin.FindIndex(w.buf[:end]); loc != nil {
+			w.flush(bytes.LastIndexByte(w.buf[:loc[0]], '\n') + 1)
+			w.inKey = true
+			continue
+		}
+		if end == 0 {
+			return
+		}
+		w.flush(end)
+	}
+}
+
+// flush writes the first n bytes of the buffer, redacted
+func (w *Writer) flush(n int) {
+	if n == 0 {
+		return
+	}
+	_, w.err = io.WriteString(w.w, w.r.Redact(string(w.buf[:n])))
+	w.buf = append(w.buf[:0], w.buf[n:]...)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/schollz/progressbar/v3"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -24,6 +25,25 @@ func NewSpinner(desc string) *progressbar.ProgressBar {
 
 }
 
+// RunWithStoppableSpinner is like RunWithSpinner, but fn can remove the spinner early
+// by calling stop, e.g. before printing to the terminal
+func RunWithStoppableSpinner(enable bool, desc string, fn func(stop func())) {
+	if !enable {
+		fn(func() {})
+		return
+	}
+	bar := NewSpinner(desc)
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			bar.Clear()
+			bar.Exit()
+		})
+	}
+	defer stop()
+	fn(stop)
+}
+
 func RunWithSpinner(enable bool, desc string, fn func()) {
 	if !enable {
 		fn()
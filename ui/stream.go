@@ -0,0 +1,81 @@
+package ui
+
+import (
+	"io"
+	"strings"
+	"sync"
+
+	markdown "github.com/MichaelMure/go-term-markdown"
+)
+
+// MarkdownStream renders markdown received in chunks, printing each block (paragraph,
+// list, code block...) as soon as it is complete
+type MarkdownStream struct {
+	mu       sync.Mutex
+	out      io.Writer
+	width    int
+	padding  int
+	buf      strings.Builder
+	rendered bool
+}
+
+func NewMarkdownStream(out io.Writer, width int, padding int) *MarkdownStream {
+	return &MarkdownStream{out: out, width: width, padding: padding}
+}
+
+// Write adds a chunk of markdown, rendering the blocks it completes
+func (s *MarkdownStream) Write(chunk string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buf.WriteString(chunk)
+	s.flush(false)
+}
+
+// Close renders what is left in the buffer
+func (s *MarkdownStream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flush(true)
+}
+
+// Rendered tells whether anything was printed
+func (s *MarkdownStream) Rendered() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rendered
+}
+
+func (s *MarkdownStream) flush(final bool) {
+	data := s.buf.String()
+	cut := 0
+	if final {
+		cut = len(data)
+	} else {
+		// Cut after the last blank line that is not inside a code block
+		inFence := false
+		pos := 0
+		for {
+			nl := strings.IndexByte(data[pos:], '\n')
+			if nl < 0 {
+				break
+			}
+			line := strings.TrimSpace(data[pos : pos+nl])
+			pos += nl + 1
+			if strings.HasPrefix(line, "```") {
+				inFence = !inFence
+			}
+			if !inFence && line == "" {
+				cut = pos
+			}
+		}
+	}
+
+	block := data[:cut]
+	if strings.TrimSpace(block) == "" {
+		return
+	}
+	s.out.Write(markdown.Render(block, s.width, s.padding))
+	s.rendered = true
+	s.buf.Reset()
+	s.buf.WriteString(data[cut:])
+}
@@ -0,0 +1,815 @@
+package workflow
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/remijnoel/ailops/models"
+	"github.com/remijnoel/ailops/policy"
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+const MAX_NESTED_SHELLS = 5 // Levels of sh -c '...' parsed before giving up
+
+// mutatingPrograms alter the state of the host whatever their arguments
+var mutatingPrograms = setOf(
+	"rm", "rmdir", "unlink", "mv", "cp", "dd", "shred", "truncate", "fallocate", "mkswap", "fdisk", "sfdisk",
+	"parted", "wipefs", "chmod", "chown", "chgrp", "chattr", "setfacl", "ln", "mkdir", "mknod", "mkfifo",
+	"touch", "tee", "install", "rsync", "scp", "wget", "patch", "kill", "killall", "pkill", "reboot",
+	"shutdown", "halt", "poweroff", "init", "telinit", "useradd", "userdel", "usermod", "groupadd",
+	"groupdel", "groupmod", "passwd", "chpasswd", "visudo", "mount", "umount", "swapon", "swapoff",
+	"modprobe", "rmmod", "insmod", "renice", "logrotate",
+)
+
+// mutatingSubcommands are the subcommands altering the state of the host, looked for in
+// the first two arguments that are not options (e.g. "docker container rm")
+var mutatingSubcommands = map[string]map[string]bool{
+	"systemctl": setOf("start", "stop", "restart", "reload", "try-restart", "reload-or-restart", "enable",
+		"disable", "mask", "unmask", "kill", "isolate", "daemon-reload", "set-property", "set-default", "edit",
+		"reboot", "poweroff", "halt"),
+	"service":     setOf("start", "stop", "restart", "reload", "force-reload"),
+	"apt":         setOf("install", "remove", "purge", "upgrade", "full-upgrade", "dist-upgrade", "autoremove", "update"),
+	"apt-get":     setOf("install", "remove", "purge", "upgrade", "dist-upgrade", "autoremove", "update", "clean"),
+	"yum":         setOf("install", "remove", "erase", "update", "upgrade", "downgrade", "clean"),
+	"dnf":         setOf("install", "remove", "erase", "update", "upgrade", "downgrade", "clean"),
+	"zypper":      setOf("install", "in", "remove", "rm", "update", "up", "dist-upgrade", "dup"),
+	"apk":         setOf("add", "del", "upgrade", "update"),
+	"snap":        setOf("install", "remove", "refresh"),
+	"pip":         setOf("install", "uninstall"),
+	"pip3":        setOf("install", "uninstall"),
+	"npm":         setOf("install", "uninstall", "update"),
+	"docker":      setOf("rm", "rmi", "stop", "kill", "restart", "start", "run", "exec", "create", "pause", "unpause", "cp", "prune", "update", "pull", "push", "build"),
+	"podman":      setOf("rm", "rmi", "stop", "kill", "restart", "start", "run", "exec", "create", "pause", "unpause", "cp", "prune", "update", "pull", "push", "build"),
+	"kubectl":     setOf("delete", "apply", "create", "edit", "patch", "replace", "scale", "rollout", "drain", "cordon", "uncordon", "taint", "label", "annotate", "exec", "cp", "run", "set", "expose", "autoscale"),
+	"git":         setOf("commit", "push", "pull", "fetch", "reset", "checkout", "switch", "restore", "clean", "merge", "rebase", "stash", "rm", "mv", "add", "tag", "init", "clone"),
+	"ip":          setOf("add", "del", "delete", "set", "flush", "change", "replace", "append", "exec"),
+	"nft":         setOf("add", "delete", "flush", "insert", "replace", "create", "destroy"),
+	"hostnamectl": setOf("set-hostname", "hostname", "set-icon-name", "set-chassis", "set-deployment", "set-location"),
+	"timedatectl": setOf("set-time", "set-timezone", "set-local-rtc", "set-ntp"),
+}
+
+// mutatingOptions are the options making an otherwise read-only program alter the host
+var mutatingOptions = map[string][]string{
+	"sed":        {"-i", "--in-place"},
+	"sysctl":     {"-w", "--write", "-p", "--load", "--system"},
+	"crontab":    {"-r", "-e", "--remove", "--edit"},
+	"find":       {"-delete", "-fprint", "-fprint0", "-fprintf", "-fls"},
+	"date":       {"-s", "--set"},
+	"curl":       {"-o", "-O", "--output", "--remote-name", "--remote-name-all", "-T", "--upload-file"},
+	"tar":        {"-x", "-c", "-r", "-u", "-A", "--extract", "--create", "--append", "--update", "--delete", "--catenate", "--concatenate"},
+	"iptables":   {"-A", "-D", "-I", "-R", "-F", "-X", "-P", "-N", "-Z", "-E", "--append", "--delete", "--insert", "--replace", "--flush", "--delete-chain", "--policy", "--new-chain", "--zero", "--rename-chain"},
+	"ip6tables":  {"-A", "-D", "-I", "-R", "-F", "-X", "-P", "-N", "-Z", "-E", "--append", "--delete", "--insert", "--replace", "--flush", "--delete-chain", "--policy", "--new-chain", "--zero", "--rename-chain"},
+	"journalctl": {"--vacuum-size", "--vacuum-time", "--vacuum-files", "--rotate", "--flush"},
+	"hwclock":    {"-w", "-s", "--systohc", "--hctosys", "--set"},
+	"strace":     {"-o", "--output"},
+	"ltrace":     {"-o", "--output"},
+	"time":       {"-o", "--output"},
+}
+
+// subcommandOptions are the options taking a value that may precede the subcommand, e.g.
+// "git --git-dir /srv/repo reset"
+var subcommandOptions = map[string][]string{
+	"git":       {"-C", "-c", "--git-dir", "--work-tree", "--namespace", "--super-prefix", "--config-env"},
+	"docker":    {"-H", "-c", "-l", "--host", "--context", "--config", "--log-level"},
+	"podman":    {"-c", "--connection", "--url", "--root", "--runroot", "--log-level"},
+	"kubectl":   {"-n", "-s", "--namespace", "--context", "--cluster", "--user", "--server", "--kubeconfig", "--as", "--token"},
+	"systemctl": {"-H", "-M", "-t", "-p", "-s", "-n", "-o", "--host", "--machine", "--type", "--property", "--signal", "--lines", "--output", "--state", "--root"},
+	"ip":        {"-n", "-netns", "-l", "-loops", "-rc", "-rcvbuf"},
+}
+
+// shells run the script given with -c, which is checked like the command itself
+var shells = setOf("sh", "bash", "dash", "zsh", "ksh", "ash", "busybox")
+
+// interpreters run code that cannot be checked, including the commands run later by trap and at
+var interpreters = setOf("eval", "source", ".", "trap", "at", "batch", "python", "python2", "python3", "perl",
+	"ruby", "node", "php", "lua")
+
+// awks run scripts that are checked for commands and output redirections, see awkOperation
+var awks = setOf("awk", "gawk", "mawk", "nawk")
+
+// launchers run a command line given as a single argument, on another host or as a service,
+// or let commands be run from within, as editors and pagers do. The commands are not checked.
+var launchers = setOf("su", "runuser", "script", "watch", "ssh", "systemd-run", "flock",
+	"vi", "vim", "nvim", "view", "ex", "ed", "emacs", "nano", "less", "more", "most")
+
+// wrapperOptions are the options taking a value of the programs running another command
+var wrapperOptions = map[string][]string{
+	"sudo":    {"-u", "-g", "-p", "-C", "-D", "-r", "-t", "-U", "-T", "--user", "--group", "--prompt", "--chdir", "--host", "--role", "--type", "--other-user", "--command-timeout", "--close-from"},
+	"env":     {"-u", "-C", "--unset", "--chdir"},
+	"nice":    {"-n", "--adjustment"},
+	"nohup":   {},
+	"timeout": {"-s", "-k", "--signal", "--kill-after"},
+	"stdbuf":  {"-i", "-o", "-e", "--input", "--output", "--error"},
+	"ionice":  {"-c", "-n", "-t", "--class", "--classdata"},
+	"time":    {"-f", "-o", "--format", "--output"},
+	"command": {},
+	"exec":    {"-a"},
+	"xargs":   {"-a", "-d", "-E", "-I", "-L", "-n", "-P", "-s", "--arg-file", "--delimiter", "--max-args", "--max-lines", "--max-procs", "--max-chars", "--process-slot-var"},
+	"setsid":  {},
+	"chroot":  {},
+	"nsenter": {"-t", "-S", "-G", "--target", "--setuid", "--setgid"},
+	"strace":  {"-e", "-o", "-p", "-s", "-u", "-a", "-b", "-E", "-I", "-O", "-P", "-S", "-X"},
+	"ltrace":  {"-e", "-o", "-p", "-s", "-u", "-a", "-A", "-D", "-F", "-l", "-n", "-w"},
+	"doas":    {"-u", "-C"},
+	"pkexec":  {"--user"},
+	"taskset": {},
+	"unshare": {"-S", "-G", "-R", "-w", "--setuid", "--setgid", "--root", "--wd", "--propagation", "--setgroups", "--map-user", "--map-group", "--map-users", "--map-groups"},
+	"chrt":    {"-T", "-P", "-D", "--sched-runtime", "--sched-period", "--sched-deadline"},
+	"setpriv": {"--reuid", "--regid", "--ruid", "--rgid", "--euid", "--egid", "--groups", "--inh-caps", "--ambient-caps", "--bounding-set", "--securebits", "--pdeathsig", "--selinux-label", "--apparmor-profile"},
+	"builtin": {},
+}
+
+// wrapperOperands are the arguments preceding the command of a wrapper, e.g. the duration
+// of timeout or the CPU mask of taskset
+var wrapperOperands = map[string]int{"timeout": 1, "chroot": 1, "taskset": 1, "chrt": 1}
+
+// CheckCommand parses the command line and applies the command restrictions to each of its
+// simple commands, including the ones of pipelines, lists, substitutions and of the commands
+// run by sudo, xargs, find -exec and sh -c. It returns why the command is not allowed.
+func CheckCommand(command string, config *models.DebugSessionConfig) error {
+	return newCommandChecker(config).check(command, 0)
+}
+
+// PolicyDecision is the decision of the policy file on a simple command
+type PolicyDecision struct {
+	Command  string // Simple command as written, e.g. "sudo systemctl status nginx"
+	Decision policy.Decision
+}
+
+// ExplainCommand checks the command like CheckCommand, and returns the decision of the
+// policy file on each simple command evaluated before the command was allowed or rejected
+func ExplainCommand(command string, config *models.DebugSessionConfig) ([]PolicyDecision, error) {
+	c := newCommandChecker(config)
+	c.decisions = []PolicyDecision{}
+	err := c.check(command, 0)
+	return c.decisions, err
+}
+
+type commandChecker struct {
+	config    *models.DebugSessionConfig
+	scope     policy.Scope
+	decisions []PolicyDecision // Recorded when not nil
+}
+
+func newCommandChecker(config *models.DebugSessionConfig) *commandChecker {
+	scope := policy.Scope{Host: targetExecutor(config).Host(), Environment: config.Environment}
+	return &commandChecker{config: config, scope: scope}
+}
+
+func (c *commandChecker) check(script string, depth int) error {
+	if depth > MAX_NESTED_SHELLS {
+		return fmt.Errorf("too many nested shells")
+	}
+	file, err := syntax.NewParser(syntax.Variant(syntax.LangBash)).Parse(strings.NewReader(script), "")
+	if err != nil {
+		return fmt.Errorf("cannot parse the command: %w", err)
+	}
+	syntax.Walk(file, func(node syntax.Node) bool {
+		if err != nil {
+			return false
+		}
+		switch n := node.(type) {
+		case *syntax.Redirect:
+			err = c.checkRedirect(n)
+		case *syntax.CallExpr:
+			if len(n.Args) > 0 {
+				args := make([]string, len(n.Args))
+				for i, word := range n.Args {
+					args[i] = wordValue(word)
+				}
+				err = c.checkArgs(strings.Join(args, " "), args, depth)
+			}
+		}
+		return err == nil
+	})
+	return err
+}
+
+// checkArgs checks a simple command, text being the command as written and args its words
+func (c *commandChecker) checkArgs(text string, args []string, depth int) error {
+	args, wrappers := unwrap(args)
+	for _, wrapper := range wrappers {
+		name := path.Base(wrapper[0])
+		if operation := mutatingOperation(name, wrapper); operation != "" {
+			if err := c.checkPermitted(name, operation, "modifies the system"); err != nil {
+				return err
+			}
+		}
+	}
+	if len(args) == 0 {
+		return nil // e.g. xargs without a command runs echo
+	}
+	replace := xargsReplace(wrappers)
+	if isDynamic(args[0]) || replace != "" && strings.Contains(args[0], replace) {
+		return fmt.Errorf("the program of %q is only known at run time", text)
+	}
+	name := path.Base(args[0])
+
+	if shells[name] {
+		for i, arg := range args[1:] {
+			if matchesOption(arg, "-c") && i+2 < len(args) {
+				// xargs -I replaces the placeholders of the script with its input
+				if replace != "" && strings.Contains(args[i+2], replace) {
+					return fmt.Errorf("the script of %q is only known at run time", text)
+				}
+				return c.check(args[i+2], depth+1)
+			}
+		}
+	}
+	if name == "find" {
+		for _, inner := range findCommands(args) {
+			if err := c.checkArgs(strings.Join(inner, " "), inner, depth); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := c.checkLists(text, strings.Join(args, " ")); err != nil {
+		return err
+	}
+	if c.config.Policy != nil {
+		decision := c.config.Policy.Evaluate(args, c.scope)
+		if c.decisions != nil {
+			c.decisions = append(c.decisions, PolicyDecision{Command: text, Decision: decision})
+		}
+		if decision.Action == policy.ACTION_DENY {
+			return fmt.Errorf("%q is denied by %s of the policy", strings.Join(args, " "), decision)
+		}
+		if decision.Rule != nil && decision.Rule.Mutating {
+			return nil // The rule explicitly permits the command to alter the host
+		}
+	}
+
+	if shells[name] {
+		return c.checkPermitted(name, name, "runs commands that cannot be checked")
+	}
+	if interpreters[name] {
+		return c.checkPermitted(name, name, "runs code that cannot be checked")
+	}
+	if launchers[name] {
+		return c.checkPermitted(name, name, "runs commands that cannot be checked")
+	}
+	if operation := mutatingOperation(name, args); operation != "" {
+		return c.checkPermitted(name, operation, "modifies the system")
+	}
+	return nil
+}
+
+// checkLists applies the whitelist and the blacklist to the command as written and to
+// the command without its wrappers, so that "sudo df -h" is allowed by "df"
+func (c *commandChecker) checkLists(text, unwrapped string) error {
+	if len(c.config.CommandWhitelist) > 0 {
+		if !matchesCommand(c.config.CommandWhitelist, text) && !matchesCommand(c.config.CommandWhitelist, unwrapped) {
+			return fmt.Errorf("%q is not in the whitelist", unwrapped)
+		}
+		return nil
+	}
+	if matchesCommand(c.config.CommandBlacklist, text) || matchesCommand(c.config.CommandBlacklist, unwrapped) {
+		return fmt.Errorf("%q is in the blacklist", unwrapped)
+	}
+	return nil
+}
+
+// checkPermitted rejects the operation of program unless allowed_mutating_commands lists
+// the program or the operation
+func (c *commandChecker) checkPermitted(program, operation, reason string) error {
+	for _, permitted := range c.config.AllowedMutatingCommands {
+		if permitted == program || permitted == operation {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s %s", operation, reason)
+}
+
+func (c *commandChecker) checkRedirect(r *syntax.Redirect) error {
+	switch r.Op {
+	case syntax.RdrOut, syntax.AppOut, syntax.RdrInOut, syntax.ClbOut, syntax.RdrAll, syntax.AppAll:
+	case syntax.DplOut:
+		// 2>&1 duplicates a descriptor, >&file writes to a file
+		if target := wordValue(r.Word); target == "-" || isNumber(target) {
+			return nil
+		}
+	default:
+		return nil
+	}
+	target := wordValue(r.Word)
+	if target == "/dev/null" || c.config.AllowOutputRedirects {
+		return nil
+	}
+	return fmt.Errorf("output redirection to %s is not allowed", target)
+}
+
+// unwrap removes the programs running another command, such as sudo or xargs, and the
+// environment assignments of env. It returns the command, and each wrapper with its
+// options, e.g. ["time", "-o", "file"].
+func unwrap(args []string) ([]string, [][]string) {
+	var wrappers [][]string
+	for len(args) > 0 {
+		options, ok := wrapperOptions[path.Base(args[0])]
+		if !ok || isLookup(args) {
+			return args, wrappers
+		}
+		wrapper := path.Base(args[0])
+		own := []string{args[0]}
+		args = args[1:]
+	options:
+		for len(args) > 0 {
+			arg := args[0]
+			switch {
+			case arg == "--":
+				args = args[1:]
+				break options
+			case wrapper == "env" && isSplitString(arg):
+				// env -S splits its value into the program and its first arguments
+				value, rest := splitStringValue(args)
+				args = append(splitWords(value), rest...)
+				break options
+			case strings.HasPrefix(arg, "-") && arg != "-":
+				own = append(own, arg)
+				args = args[1:]
+				if takesValue(options, arg) && len(args) > 0 {
+					own = append(own, args[0])
+					args = args[1:]
+				}
+			case wrapper == "env" && strings.Contains(arg, "="):
+				args = args[1:]
+			default:
+				break options
+			}
+		}
+		n := min(wrapperOperands[wrapper], len(args))
+		if (wrapper == "taskset" || wrapper == "chrt") && (hasOption(own, "-p") || hasOption(own, "--pid")) {
+			n = len(args) // They act on a running process, and run no command
+		}
+		own = append(own, args[:n]...)
+		args = args[n:]
+		wrappers = append(wrappers, own)
+	}
+	return args, wrappers
+}
+
+// isLookup tells whether the command is "command -v" or "command -V", which only look
+// programs up instead of running them
+func isLookup(args []string) bool {
+	if path.Base(args[0]) != "command" {
+		return false
+	}
+	for _, arg := range args[1:] {
+		if !strings.HasPrefix(arg, "-") || arg == "--" {
+			return false
+		}
+		if matchesOption(arg, "-v") || matchesOption(arg, "-V") {
+			return true
+		}
+	}
+	return false
+}
+
+// xargsReplace returns the string replaced by the input of xargs in its command, set by
+// -I, -i or --replace, or an empty string when xargs appends its input to the command
+func xargsReplace(wrappers [][]string) string {
+	for _, wrapper := range wrappers {
+		if path.Base(wrapper[0]) != "xargs" {
+			continue
+		}
+		for i := 1; i < len(wrapper); i++ {
+			arg := wrapper[i]
+			switch {
+			case arg == "-I" && i+1 < len(wrapper):
+				return wrapper[i+1]
+			case strings.HasPrefix(arg, "-I") && len(arg) > 2:
+				return arg[2:]
+			case strings.HasPrefix(arg, "--replace="):
+				return strings.TrimPrefix(arg, "--replace=")
+			case arg == "-i" || arg == "--replace":
+				return "{}"
+			case strings.HasPrefix(arg, "-i"):
+				return arg[2:]
+			}
+		}
+	}
+	return ""
+}
+
+// isSplitString tells whether the option of env is -S or --split-string, possibly with
+// its value
+func isSplitString(arg string) bool {
+	return strings.HasPrefix(arg, "--split-string") || strings.HasPrefix(arg, "-S") ||
+		shortOptions.MatchString(arg) && strings.Contains(arg, "S")
+}
+
+// splitStringValue returns the value of the -S option starting args, and the arguments
+// following it
+func splitStringValue(args []string) (string, []string) {
+	arg := args[0]
+	if value, ok := strings.CutPrefix(arg, "--split-string="); ok {
+		return value, args[1:]
+	}
+	if i := strings.Index(arg, "S"); arg != "--split-string" && i < len(arg)-1 {
+		return arg[i+1:], args[1:] // -S'rm -rf /' or -iS'rm -rf /'
+	}
+	if len(args) < 2 {
+		return "", nil
+	}
+	return args[1], args[2:]
+}
+
+// splitWords splits a string into words like a shell would, without running anything
+func splitWords(s string) []string {
+	file, err := syntax.NewParser(syntax.Variant(syntax.LangBash)).Parse(strings.NewReader(s), "")
+	if err == nil && len(file.Stmts) == 1 {
+		if call, ok := file.Stmts[0].Cmd.(*syntax.CallExpr); ok && len(file.Stmts[0].Redirs) == 0 && len(call.Assigns) == 0 {
+			words := make([]string, len(call.Args))
+			for i, word := range call.Args {
+				words[i] = wordValue(word)
+			}
+			return words
+		}
+	}
+	return strings.Fields(s)
+}
+
+// takesValue tells whether the option is followed by a value in the next argument
+func takesValue(options []string, arg string) bool {
+	if strings.Contains(arg, "=") {
+		return false
+	}
+	for _, option := range options {
+		if arg == option {
+			return true
+		}
+	}
+	return false
+}
+
+// findCommands returns the commands run by the -exec, -execdir, -ok and -okdir actions of find
+func findCommands(args []string) [][]string {
+	var commands [][]string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-exec", "-execdir", "-ok", "-okdir":
+			var command []string
+			for i++; i < len(args) && args[i] != ";" && args[i] != "+"; i++ {
+				command = append(command, args[i])
+			}
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
+
+// mutatingOperation returns the operation of the command altering the host, e.g. "rm" or
+// "systemctl restart", or an empty string when the command is read-only
+func mutatingOperation(name string, args []string) string {
+	if mutatingPrograms[name] || strings.HasPrefix(name, "mkfs") {
+		return name
+	}
+	if name == "sed" {
+		if operation := sedOperation(args); operation != "" {
+			return operation
+		}
+	}
+	if awks[name] {
+		return awkOperation(name, args)
+	}
+	var positional []string
+	for i := 1; i < len(args); i++ {
+		switch arg := args[i]; {
+		case takesValue(subcommandOptions[name], arg):
+			i++
+		case !strings.HasPrefix(arg, "-"):
+			positional = append(positional, arg)
+		}
+	}
+	for _, arg := range positional[:min(len(positional), 2)] {
+		if mutatingSubcommands[name][arg] {
+			return name + " " + arg
+		}
+	}
+	for _, arg := range args[1:] {
+		for _, option := range mutatingOptions[name] {
+			if matchesOption(arg, option) {
+				return name + " " + option
+			}
+		}
+	}
+	switch name {
+	case "hostname":
+		if len(positional) > 0 {
+			return name
+		}
+	case "sysctl":
+		for _, arg := range positional {
+			if strings.Contains(arg, "=") {
+				return name + " -w"
+			}
+		}
+	case "crontab":
+		// Without -l, crontab installs the table of a file or of its input
+		if !hasOption(args, "-l") {
+			return name
+		}
+	case "tar":
+		// Old-style bundles of options without a dash, e.g. "tar xzf foo.tar"
+		if len(args) > 1 && bundledOptions.MatchString(args[1]) {
+			if i := strings.IndexAny(args[1], "xcruA"); i >= 0 {
+				return name + " -" + args[1][i:i+1]
+			}
+		}
+	case "taskset", "chrt":
+		// With -p, the attributes of the process are only read when it is the sole operand
+		if (hasOption(args, "-p") || hasOption(args, "--pid")) && len(positional) > 1 {
+			return name + " -p"
+		}
+	}
+	return ""
+}
+
+var bundledOptions = regexp.MustCompile(`^[a-zA-Z]+$`)
+
+// hasOption tells whether one of the arguments sets the option
+func hasOption(args []string, option string) bool {
+	for _, arg := range args[1:] {
+		if matchesOption(arg, option) {
+			return true
+		}
+	}
+	return false
+}
+
+// awkOperation returns the operation of an awk command that may run commands or write
+// files: scripts calling system, piping or redirecting their output, or using the @ syntax
+// of gawk (indirect calls, extensions), and the options other than -F and -v, which read
+// the script or extensions from files, edit files in place or write profiles
+func awkOperation(name string, args []string) string {
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--sandbox":
+			return "" // gawk disables system and the redirections
+		case arg == "-F" || arg == "-v" || arg == "--field-separator" || arg == "--assign":
+			i++
+		case strings.HasPrefix(arg, "-F") || strings.HasPrefix(arg, "-v") ||
+			strings.HasPrefix(arg, "--field-separator=") || strings.HasPrefix(arg, "--assign="):
+		case arg == "--":
+			if i+1 < len(args) {
+				return awkScriptOperation(name, args[i+1])
+			}
+			return ""
+		case strings.HasPrefix(arg, "-") && arg != "-":
+			return name + " " + arg
+		default:
+			return awkScriptOperation(name, arg)
+		}
+	}
+	return ""
+}
+
+// awkScriptOperation returns the operation of an awk script running commands or writing files
+func awkScriptOperation(name, script string) string {
+	switch {
+	case strings.Contains(script, "system"):
+		return name + " system"
+	case strings.Contains(script, "|"):
+		return name + " |"
+	case strings.Contains(script, ">"):
+		return name + " >"
+	case strings.Contains(script, "@"):
+		return name + " @"
+	}
+	return ""
+}
+
+// sedOperation returns the operation of a sed command running commands or writing files:
+// the e and w commands of its scripts, or -f whose script is not checked
+func sedOperation(args []string) string {
+	var scripts, positional []string
+	explicit := false // Scripts given with -e, the first positional argument is then a file
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--sandbox":
+			return "" // GNU sed rejects the e, w and r commands
+		case arg == "--":
+			positional = append(positional, args[i+1:]...)
+			i = len(args)
+		case arg == "--expression" && i+1 < len(args):
+			explicit = true
+			i++
+			scripts = append(scripts, args[i])
+		case strings.HasPrefix(arg, "--expression="):
+			explicit = true
+			scripts = append(scripts, strings.TrimPrefix(arg, "--expression="))
+		case arg == "--file" || strings.HasPrefix(arg, "--file="):
+			return "sed -f"
+		case arg == "--line-length":
+			i++
+		case strings.HasPrefix(arg, "--"):
+		case strings.HasPrefix(arg, "-") && arg != "-":
+			// Grouped short options, e.g. -ne 'p', the value of -e, -l and -i may be attached
+		short:
+			for j := 1; j < len(arg); j++ {
+				switch arg[j] {
+				case 'e':
+					explicit = true
+					if j+1 < len(arg) {
+						scripts = append(scripts, arg[j+1:])
+					} else if i+1 < len(args) {
+						i++
+						scripts = append(scripts, args[i])
+					}
+					break short
+				case 'f':
+					return "sed -f"
+				case 'l':
+					if j+1 == len(arg) {
+						i++
+					}
+					break short
+				case 'i':
+					break short // The suffix of the backups
+				}
+			}
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	if !explicit && len(positional) > 0 {
+		scripts = append(scripts, positional[0])
+	}
+	for _, script := range scripts {
+		if operation := sedScriptOperation(script); operation != "" {
+			return operation
+		}
+	}
+	return ""
+}
+
+// sedScriptOperation returns "sed e" or "sed w" when the script runs commands or writes
+// files, with the e, w and W commands or the e and w flags of s
+func sedScriptOperation(script string) string {
+	for i := 0; i < len(script); {
+		i = skipSedAddresses(script, i)
+		if i >= len(script) {
+			break
+		}
+		command := script[i]
+		i++
+		switch command {
+		case 'e':
+			return "sed e"
+		case 'w', 'W':
+			return "sed w"
+		case 's':
+			i = skipSedDelimited(script, i, 2)
+			for ; i < len(script) && !strings.ContainsRune(";\n}", rune(script[i])); i++ {
+				switch script[i] {
+				case 'e':
+					return "sed e"
+				case 'w':
+					return "sed w"
+				}
+			}
+		case 'y':
+			i = skipSedDelimited(script, i, 2)
+		case 'a', 'i', 'c', 'r', 'R', '#':
+			// Text or file name up to the end of the line
+			for i < len(script) && script[i] != '\n' {
+				i++
+			}
+		case ':', 'b', 't', 'T':
+			for i < len(script) && script[i] != '\n' && script[i] != ';' {
+				i++
+			}
+		}
+	}
+	return ""
+}
+
+// skipSedAddresses skips the separators, the addresses and the negation preceding a command
+func skipSedAddresses(script string, i int) int {
+	for i < len(script) {
+		c := script[i]
+		switch {
+		case strings.ContainsRune(" \t\n;{}!,", rune(c)):
+			i++
+		case c >= '0' && c <= '9' || c == '$' || c == '+' || c == '~':
+			i++
+		case c == '/':
+			i = skipSedDelimited(script, i, 1)
+			for i < len(script) && (script[i] == 'I' || script[i] == 'M') {
+				i++
+			}
+		case c == '\\' && i+1 < len(script):
+			i = skipSedDelimited(script, i+1, 1)
+			for i < len(script) && (script[i] == 'I' || script[i] == 'M') {
+				i++
+			}
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// skipSedDelimited skips the n parts following the delimiter at script[i], e.g. the
+// pattern and the replacement of s/a/b/
+func skipSedDelimited(script string, i int, n int) int {
+	if i >= len(script) {
+		return i
+	}
+	delimiter := script[i]
+	i++
+	for ; n > 0 && i < len(script); i++ {
+		switch script[i] {
+		case '\\':
+			i++
+		case delimiter:
+			n--
+		}
+	}
+	return i
+}
+
+var shortOptions = regexp.MustCompile(`^-[a-zA-Z]+$`)
+
+// matchesOption tells whether arg sets the option, including "--option=value", "-ibak"
+// and the grouped short options such as "-ni"
+func matchesOption(arg, option string) bool {
+	if arg == option || strings.HasPrefix(arg, option+"=") {
+		return true
+	}
+	if len(option) != 2 || strings.HasPrefix(arg, "--") {
+		return false
+	}
+	return strings.HasPrefix(arg, option) || shortOptions.MatchString(arg) && strings.Contains(arg[1:], option[1:])
+}
+
+func matchesCommand(patterns []string, command string) bool {
+	for _, pattern := range patterns {
+		if regexp.MustCompile("^" + regexp.QuoteMeta(pattern) + `(\s|$)`).MatchString(command) {
+			return true
+		}
+	}
+	return false
+}
+
+// wordValue returns the value of a word after the removal of its quotes, or the word as
+// written when its value is only known at run time (e.g. "$HOME" or "$(date)")
+func wordValue(word *syntax.Word) string {
+	if isLiteral(word) {
+		if fields, err := expand.Fields(nil, word); err == nil && len(fields) == 1 {
+			return fields[0]
+		}
+		if value, err := expand.Literal(nil, word); err == nil {
+			return value // e.g. "", which has no field
+		}
+	}
+	var b strings.Builder
+	syntax.NewPrinter().Print(&b, word)
+	return b.String()
+}
+
+func isLiteral(word *syntax.Word) bool {
+	for _, part := range word.Parts {
+		switch p := part.(type) {
+		case *syntax.Lit, *syntax.SglQuoted:
+		case *syntax.DblQuoted:
+			for _, q := range p.Parts {
+				if _, ok := q.(*syntax.Lit); !ok {
+					return false
+				}
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func isDynamic(s string) bool {
+	return strings.ContainsAny(s, "$`*?")
+}
+
+func isNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func setOf(values ...string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
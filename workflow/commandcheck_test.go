@@ -0,0 +1,165 @@
+package workflow
+
+import (
+	"testing"
+
+	"github.com/remijnoel/ailops/models"
+	"github.com/remijnoel/ailops/policy"
+)
+
+func TestCheckCommand(t *testing.T) {
+	tests := []struct {
+		command   string
+		allowed   bool
+		permitted []string // allowed_mutating_commands
+	}{
+		// Read-only commands
+		{command: "ls -la /var/log", allowed: true},
+		{command: "ps aux | grep nginx", allowed: true},
+		{command: "df -h; free -m", allowed: true},
+		{command: "ls /nope 2>/dev/null || echo missing 2>&1", allowed: true},
+		{command: "sudo systemctl status nginx", allowed: true},
+		{command: "journalctl -u nginx -n 50 --no-pager", allowed: true},
+		{command: "find /var/log -name '*.log' -mtime -1", allowed: true},
+		{command: "sh -c 'ls /tmp'", allowed: true},
+		{command: "sed -n 1,10p /etc/hosts", allowed: true},
+		{command: "command -v rm", allowed: true},
+		{command: "command -V systemctl", allowed: true},
+		{command: "awk '{print $1}' /etc/passwd", allowed: true},
+		{command: "awk -F: '$3 == 0 {print $1}' /etc/passwd", allowed: true},
+		{command: "tar tf backup.tar", allowed: true},
+		{command: "tar -tzvf backup.tgz", allowed: true},
+		{command: "git -C /srv/repo log --oneline", allowed: true},
+		{command: "git status", allowed: true},
+		{command: "kubectl -n default get pods", allowed: true},
+		{command: "crontab -l", allowed: true},
+		{command: "crontab -u www-data -l", allowed: true},
+		{command: "taskset -p 1234", allowed: true},
+		{command: "taskset -c 0 ls", allowed: true},
+		{command: "xargs -I{} ls {}", allowed: true},
+		{command: "ip -br addr", allowed: true},
+
+		// Commands altering the host
+		{command: "rm -rf /tmp/x"},
+		{command: "sudo rm x"},
+		{command: "systemctl restart nginx"},
+		{command: "systemctl restart nginx", allowed: true, permitted: []string{"systemctl restart"}},
+		{command: "sed -i s/a/b/ /etc/hosts"},
+		{command: "sed 's/a/b/e' /etc/hosts"},
+		{command: "find / -name core -delete"},
+		{command: `find /tmp -exec rm {} \;`},
+		{command: "echo $(rm x)"},
+		{command: "ls > /tmp/x"},
+		{command: "kubectl -n default delete pod web-1"},
+		{command: "ip -n blue link del eth0"},
+
+		// Programs known only at run time
+		{command: "$CMD"},
+		{command: "xargs -I{} sh -c '{}'"},
+		{command: "ls | xargs -I % sh -c 'cat %'"},
+		{command: "xargs --replace sh -c 'rm {}'"},
+		{command: "xargs -I{} {}"},
+
+		// Code that cannot be checked
+		{command: "sh -c"},
+		{command: "python3 -c 'print(1)'"},
+		{command: "trap 'rm -rf /tmp/x' EXIT; ls"},
+		{command: "builtin eval 'rm x'"},
+		{command: "echo 'rm x' | at now"},
+		{command: "echo 'rm x' | batch"},
+		{command: "awk 'BEGIN { system(\"rm x\") }'"},
+		{command: "awk '{ print > \"/tmp/x\" }' /etc/hosts"},
+		{command: "awk '{ print | \"sh\" }' /etc/hosts"},
+		{command: "awk -f script.awk /etc/hosts"},
+		{command: "gawk -i inplace '{ print }' /etc/hosts"},
+		{command: "gawk 'BEGIN { f = \"system\"; @f(\"rm x\") }'"},
+
+		// Wrappers
+		{command: "doas rm x"},
+		{command: "doas -u root rm x"},
+		{command: "pkexec rm x"},
+		{command: "taskset -c 0 rm x"},
+		{command: "taskset 0x1 rm x"},
+		{command: "taskset -p 03 1234"},
+		{command: "unshare -r rm x"},
+		{command: "chrt 10 rm x"},
+		{command: "chrt -p 10 1234"},
+		{command: "setpriv --reuid 1000 rm x"},
+		{command: "env -S 'rm x'"},
+		{command: "env FOO=bar rm x"},
+		{command: "timeout 5 rm x"},
+
+		// Launchers
+		{command: "watch rm x"},
+		{command: "ssh web-1 rm x"},
+		{command: "su -c 'rm x'"},
+		{command: "vim -c ':!rm x' /etc/hosts"},
+		{command: "less /var/log/syslog"},
+
+		// Crontab, tar and git
+		{command: "echo '* * * * * rm x' | crontab -"},
+		{command: "crontab /tmp/cron"},
+		{command: "crontab -r"},
+		{command: "tar xf foo.tar"},
+		{command: "tar czf /tmp/etc.tgz /etc"},
+		{command: "tar -xf foo.tar"},
+		{command: "git --git-dir x --work-tree y reset --hard"},
+		{command: "git -C /srv/repo clean -fd"},
+		{command: "git -c core.pager=cat checkout main"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			err := CheckCommand(tt.command, &models.DebugSessionConfig{AllowedMutatingCommands: tt.permitted})
+			if tt.allowed && err != nil {
+				t.Errorf("CheckCommand(%q) rejected the command: %v", tt.command, err)
+			}
+			if !tt.allowed && err == nil {
+				t.Errorf("CheckCommand(%q) allowed the command", tt.command)
+			}
+		})
+	}
+}
+
+func TestCheckCommandPolicy(t *testing.T) {
+	p, err := policy.Parse([]byte(`
+default: deny
+rules:
+  - action: allow
+    program: find
+    paths: [/var/log]
+  - action: allow
+    program: systemctl
+    args: "status*"
+  - action: allow
+    program: systemctl
+    args: "restart *"
+    mutating: true
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	tests := []struct {
+		command string
+		allowed bool
+	}{
+		{"find /var/log -newer /var/log/dmesg", true},
+		{"find /var/log -delete", false},
+		{"find /var/log -exec rm {} ;", false},
+		{"find /etc", false},
+		{"systemctl status nginx", true},
+		{"systemctl status --root /tmp/x enable nginx", false},
+		{"systemctl restart nginx", true},
+		{"ls", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			err := CheckCommand(tt.command, &models.DebugSessionConfig{Policy: p})
+			if tt.allowed && err != nil {
+				t.Errorf("CheckCommand(%q) rejected the command: %v", tt.command, err)
+			}
+			if !tt.allowed && err == nil {
+				t.Errorf("CheckCommand(%q) allowed the command", tt.command)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package workflow
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"text/template"
+	"unicode/utf8"
+
+	"github.com/remijnoel/ailops/llm"
+	"github.com/remijnoel/ailops/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// DEFAULT_CONTEXT_BUDGET_FRACTION is the share of the model context used by the
+// analysis prompt when the configuration does not set one, leaving room for the
+// system prompt, the answer and the estimation error
+const DEFAULT_CONTEXT_BUDGET_FRACTION = 0.5
+
+var HistorySummaryPrompt = `You are a Linux system assistant helping to debug an issue. The debugging history below is getting too long for your context window. Summarize it so that the investigation can go on with the summary only.
+
+Keep:
+- Every command already executed (so that they are not repeated), grouped when possible.
+- Every finding, with the figures that support it (e.g. disk usage, process names, error messages).
+- The hypotheses that were confirmed or ruled out.
+
+Be concise, do not add recommendations.
+
+Problem description: {{.Session.IssueDescription}}
+
+{{if .EarlierHistory}}
+Summary of the earliest batches:
+{{.EarlierHistory}}
+------------
+{{end}}
+{{range .Batches}}
+Batch: {{.Description}}
+Commands executed:
+{{range .Actions}}
+{{.Name}}
+{{end}}
+Analysis: {{.Analysis}}
+------------
+{{end}}`
+
+type HistorySummaryInput struct {
+	Session        *models.DebugSessionLog
+	EarlierHistory string          // Summary of the batches that were already compacted
+	Batches        []*models.Batch // Batches to add to the summary
+}
+
+// AnalysisPromptWithinContext renders the command analysis prompt, compacting the
+// debugging history until the prompt fits in the share of the model context allowed
+// by the session configuration:
+//  1. all the outputs and analyses
+//  2. the outputs of the last batch only
+//  3. the older batches replaced by a summary written by the LLM
+//  4. the outputs of the last batch truncated
+func AnalysisPromptWithinContext(ctx context.Context, session *models.DebugSessionLog, provider llm.Provider) string {
+	limit := promptTokenLimit(session.Config, provider.Model())
+
+	input := CommandAnalysisInput{
+		Session:                  session,
+		IncludeAllBatchAnalysis:  true,
+		IncludeAllCommandOutputs: true,
+		EarlierHistory:           session.HistorySummary,
+		FirstBatch:               session.SummarizedBatches,
+	}
+	prompt := RenderCommandAnalysisPrompt(input)
+	if llm.EstimateTokens(prompt) <= limit {
+		return prompt
+	}
+
+	log.Infof("Analysis prompt (~%d tokens) exceeds the context budget of %d tokens, dropping older command outputs", llm.EstimateTokens(prompt), limit)
+	input.IncludeAllCommandOutputs = false
+	prompt = RenderCommandAnalysisPrompt(input)
+	if llm.EstimateTokens(prompt) <= limit {
+		return prompt
+	}
+
+	last := len(session.Batches) - 1
+	if last > session.SummarizedBatches {
+		log.Infof("Analysis prompt (~%d tokens) still exceeds the context budget, summarizing batches %d to %d", llm.EstimateTokens(prompt), session.SummarizedBatches+1, last)
+		summary, err := SummarizeHistory(ctx, session, last, provider)
+		if err != nil {
+			log.Errorf("Failed to summarize the debugging history: %v", err)
+		} else {
+			session.HistorySummary = summary
+			session.SummarizedBatches = last
+			input.EarlierHistory = summary
+			input.FirstBatch = last
+			prompt = RenderCommandAnalysisPrompt(input)
+			if llm.EstimateTokens(prompt) <= limit {
+				return prompt
+			}
+		}
+	}
+
+	// Only the outputs of the last batch are left to cut, share the remaining budget between them
+	overflow := llm.EstimateTokens(prompt) - limit
+	outputs := 0
+	for _, action := range session.Batches[last].Actions {
+		outputs += utf8.RuneCountInString(action.Output())
+	}
+	if outputs == 0 {
+		log.Warnf("Analysis prompt exceeds the context budget by ~%d tokens and cannot be compacted further", overflow)
+		return prompt
+	}
+	remaining := outputs - overflow*llm.CHARS_PER_TOKEN
+	if remaining < 0 {
+		remaining = 0
+	}
+	// Keep at least one character, 0 would disable the truncation
+	input.MaxOutputLength = max(remaining/len(session.Batches[last].Actions)-len("...[truncated]"), 1)
+	log.Infof("Truncating the command outputs of the last batch to %d characters each", input.MaxOutputLength)
+	return RenderCommandAnalysisPrompt(input)
+}
+
+// SummarizeHistory asks the LLM to summarize the batches before index end, including
+// the summary of the batches compacted previously
+func SummarizeHistory(ctx context.Context, session *models.DebugSessionLog, end int, provider llm.Provider) (string, error) {
+	tmpl := template.Must(template.New("historySummary").Funcs(promptFuncs).Parse(HistorySummaryPrompt))
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, HistorySummaryInput{
+		Session:        session,
+		EarlierHistory: session.HistorySummary,
+		Batches:        session.Batches[session.SummarizedBatches:end],
+	})
+	if err != nil {
+		return "", fmt.Errorf("error executing history summary template: %w", err)
+	}
+	return provider.RequestCompletion(ctx, buf.String())
+}
+
+// promptTokenLimit returns the number of tokens the analysis prompt may use
+func promptTokenLimit(conf *models.DebugSessionConfig, model llm.Model) int {
+	fraction := DEFAULT_CONTEXT_BUDGET_FRACTION
+	if conf != nil && conf.ContextBudgetFraction > 0 && conf.ContextBudgetFraction <= 1 {
+		fraction = conf.ContextBudgetFraction
+	}
+	return int(float64(model.ContextSizeOrDefault()) * fraction)
+}
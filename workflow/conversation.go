@@ -0,0 +1,71 @@
+package workflow
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"text/template"
+
+	"github.com/remijnoel/ailops/llm"
+	"github.com/remijnoel/ailops/models"
+	log "github.com/sirupsen/logrus"
+)
+
+var BatchResultsPrompt = `Here are the results of the batch "{{.Description}}":
+{{range .Actions}}
+	Command: {{.Name}}
+	Result: {{.Outcome}}
+	Output: {{untrusted .Output}}
+{{end}}
+Analyze them with the same rules as before.`
+
+// Conversation is the message history of the batch analyses. The first user turn holds
+// the full analysis prompt, and each following batch only adds its command outputs, so
+// that the providers can reuse the cached prefix of the conversation.
+type Conversation struct {
+	Messages []llm.Message
+}
+
+// addBatch adds the user turn asking to analyze the last batch of the session. The
+// conversation restarts from the compacted analysis prompt when it no longer fits in
+// the context budget.
+func (c *Conversation) addBatch(ctx context.Context, session *models.DebugSessionLog, provider llm.Provider) {
+	if len(c.Messages) > 0 {
+		turn := llm.Message{Role: llm.ROLE_USER, Content: BatchResultsPromptWithBatch(session.LastBatch())}
+		limit := promptTokenLimit(session.Config, provider.Model())
+		if llm.EstimateTokens(llm.FlattenMessages(c.Messages))+llm.EstimateTokens(turn.Content) <= limit {
+			c.Messages = append(c.Messages, turn)
+			return
+		}
+		log.Infof("The analysis conversation exceeds the context budget of %d tokens, starting a new one", limit)
+	}
+	c.Messages = []llm.Message{{Role: llm.ROLE_USER, Content: AnalysisPromptWithinContext(ctx, session, provider)}}
+}
+
+// addAnswer adds the analysis of the model as an assistant turn
+func (c *Conversation) addAnswer(answer CommandAnalysisResponse) {
+	encoded, err := json.Marshal(answer)
+	if err != nil {
+		log.Errorf("Failed to encode the analysis: %v", err)
+		return
+	}
+	c.Messages = append(c.Messages, llm.Message{Role: llm.ROLE_ASSISTANT, Content: string(encoded)})
+}
+
+// dropLastTurn removes the unanswered user turn, so that the next batch does not
+// follow two user turns
+func (c *Conversation) dropLastTurn() {
+	if n := len(c.Messages); n > 0 && c.Messages[n-1].Role == llm.ROLE_USER {
+		c.Messages = c.Messages[:n-1]
+	}
+}
+
+func BatchResultsPromptWithBatch(batch *models.Batch) string {
+	tmpl := template.Must(template.New("batchResults").Funcs(promptFuncs).Parse(BatchResultsPrompt))
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, batch); err != nil {
+		log.Errorf("Error executing batch results template: %v", err)
+		return ""
+	}
+	return buf.String()
+}
@@ -1,7 +1,9 @@
 package workflow
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"strings"
 	"time"
 
@@ -13,31 +15,57 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func RunLastBatch(session *models.DebugSessionLog, llmProvider llm.Provider) {
+// Providers holds the LLM providers used by the different steps of the workflow,
+// so that a cheap model can analyze each batch and a stronger one write the summary
+type Providers struct {
+	Analysis llm.Provider // Analyzes the outputs of each batch
+	Summary  llm.Provider // Writes the final analysis of the session
+	Review   llm.Provider // Reviews the recommended commands when enabled, defaults to Analysis
+}
+
+// RunLastBatch runs the commands of the last batch and analyzes their output. When conv
+// is not nil, the batch is analyzed as the next turn of the conversation instead of with
+// a prompt holding the whole history. When onAnalysis is not nil, the analysis is streamed
+// to it while it is generated.
+func RunLastBatch(ctx context.Context, session *models.DebugSessionLog, llmProvider llm.Provider, conv *Conversation, onAnalysis func(string)) {
 	batch := session.LastBatch()
 	log.Infof("Running batch: %s", batch.Description)
 
-	// For now, let's consider all Actions as commands
-	var actions []*models.Action
-	for _, action := range batch.Actions {
-		if IsCommandAllowed(action.Name, session.Config) {
-			actions = append(actions, action)
-		}
+	// Run all commands in parallel and update the actions with the results, for now
+	// let's consider all Actions as commands
+	runAllowedActions(ctx, session, batch.Actions)
+	if flagInjections(batch, session.Config) {
+		log.Warnf("The outputs of batch %s look like a prompt injection, the next commands need a confirmation", batch.Description)
 	}
 
-	// Run all commands in parallel and update the actions with the results
-	RunCommands(actions)
+	// Analyze the results using the LLM provider, recording the tokens it consumes
+	recorder := &llm.CallRecorder{}
+	ctx = llm.WithCallRecorder(ctx, recorder)
 
-	// Include all analysis history and the commands output in the prompt
-	prompt := CommandAnalysisPrompt(session, true, true)
-
-	// Analyze the results using the LLM provider
-	commandAnalysis, err := AnalyzeCommands(prompt, llmProvider)
+	var commandAnalysis CommandAnalysisResponse
+	var err error
+	if conv != nil {
+		conv.addBatch(ctx, session, llmProvider)
+		commandAnalysis, err = AnalyzeConversation(ctx, conv.Messages, llmProvider, onAnalysis)
+		if err != nil {
+			conv.dropLastTurn()
+		} else {
+			conv.addAnswer(commandAnalysis)
+		}
+	} else {
+		// Include all analysis history and the commands output in the prompt, as long as it fits in the context
+		prompt := AnalysisPromptWithinContext(ctx, session, llmProvider)
+		commandAnalysis, err = AnalyzeCommands(ctx, prompt, llmProvider, onAnalysis)
+	}
+	batch.Usage = tokenUsage(recorder.Calls(), session.Config)
+	session.Usage.Add(batch.Usage)
+	batch.Failovers = failovers(recorder)
 	if err != nil {
 		log.Errorf("Failed to analyze commands: %v", err)
 		return
 	}
 	batch.Analysis = commandAnalysis.Analysis
+	batch.Model, batch.Provider = answeredBy(recorder.Calls(), llmProvider)
 	batch.NextSteps = commandAnalysis.Recommendations
 	batch.Completed = true // Mark the batch as completed after analysis
 
@@ -53,6 +81,9 @@ func RunLastBatch(session *models.DebugSessionLog, llmProvider llm.Provider) {
 func Init(issueDescription string, conf *models.DebugSessionConfig) *models.DebugSessionLog {
 	log.Infof("Initializing debug session with issue: %s", issueDescription)
 	log.Infof("First commands to run: %v", conf.FirstCommands)
+	if conf.Redactor != nil {
+		issueDescription = conf.Redactor.Redact(issueDescription)
+	}
 
 	actions := make([]*models.Action, 0, len(conf.FirstCommands))
 	for _, cmd := range conf.FirstCommands {
@@ -62,9 +93,8 @@ func Init(issueDescription string, conf *models.DebugSessionConfig) *models.Debu
 		action := &models.Action{
 			Name:       cmd,
 			ActionType: "command",
-			Status:     "new",
+			Status:     models.STATUS_NEW,
 			Result:     "",
-			Remote:     conf.Remote, // Set the remote host if applicable
 		}
 		actions = append(actions, action)
 	}
@@ -79,10 +109,11 @@ func Init(issueDescription string, conf *models.DebugSessionConfig) *models.Debu
 	sessionLog := &models.DebugSessionLog{
 		ID:               internal.GenerateUniqueID(),
 		StartTime:        time.Now().Format(time.RFC3339),
-		Batches:          []*models.Batch{batch},
 		IssueDescription: issueDescription,
 		Config:           conf,
 	}
+	sessionLog.AddBatch(batch)
+	markDuplicates(sessionLog)
 
 	return sessionLog
 }
@@ -94,7 +125,7 @@ func PrepareNextBatch(sessionLog *models.DebugSessionLog, nextCmds []string) {
 		action := &models.Action{
 			Name:       cmd,
 			ActionType: "command",
-			Status:     "new",
+			Status:     models.STATUS_NEW,
 			Result:     "",
 		}
 		nextActions = append(nextActions, action)
@@ -106,9 +137,12 @@ func PrepareNextBatch(sessionLog *models.DebugSessionLog, nextCmds []string) {
 		NextSteps:   []string{},
 		Completed:   false,
 	})
+	markDuplicates(sessionLog)
 }
 
-func FinalAnalysis(sessionLog *models.DebugSessionLog, llmProvider llm.Provider) {
+// FinalAnalysis writes the summary of the session. When onDelta is not nil, the summary
+// is streamed to it while it is generated.
+func FinalAnalysis(ctx context.Context, sessionLog *models.DebugSessionLog, llmProvider llm.Provider, onDelta func(string)) {
 	log.Infof("Performing final analysis of the session log with ID: %s", sessionLog.ID)
 	// Get the analysis from each batch
 	analysis := ""
@@ -120,50 +154,146 @@ func FinalAnalysis(sessionLog *models.DebugSessionLog, llmProvider llm.Provider)
 
 	log.Debugf("Final analysis of batches: %s", analysis)
 	// Use the LLM provider to analyze the overall session log
-	response, err := llmProvider.RequestCompletion(FinalAnalysisPromptWithSessionLog(sessionLog))
+	recorder := &llm.CallRecorder{}
+	ctx = llm.WithCallRecorder(ctx, recorder)
+	prompt := FinalAnalysisPromptWithSessionLog(sessionLog)
+	var response string
+	var err error
+	if onDelta != nil {
+		response, err = llm.StreamCompletion(ctx, llmProvider, prompt, onDelta)
+	} else {
+		response, err = llmProvider.RequestCompletion(ctx, prompt)
+	}
+	sessionLog.Usage.Add(tokenUsage(recorder.Calls(), sessionLog.Config))
+	sessionLog.SummaryFailovers = failovers(recorder)
 	if err != nil {
 		log.Errorf("Error during final analysis: %v", err)
 		response = "Error during final analysis: " + err.Error()
 	}
 	log.Infof("Final analysis response: %s", response)
 	sessionLog.Summary = response
+	sessionLog.SummaryModel, sessionLog.SummaryProvider = answeredBy(recorder.Calls(), llmProvider)
 }
 
-func DebugWorkflow(issueDescription string, conf *models.DebugSessionConfig, interactive bool, llmProvider llm.Provider) *models.DebugSessionLog {
+// DebugWorkflow runs the debugging loop until the issue is diagnosed or ctx is cancelled.
+func DebugWorkflow(ctx context.Context, issueDescription string, conf *models.DebugSessionConfig, interactive bool, providers Providers) *models.DebugSessionLog {
 	sessionLog := Init(issueDescription, conf)
+	if conf.SafetyReview && providers.Review == nil {
+		providers.Review = providers.Analysis
+	}
 
+	investigate := investigateWithBatches
+	if conf.InvestigationMode == INVESTIGATION_MODE_TOOLS {
+		investigate = func(ctx context.Context, sessionLog *models.DebugSessionLog, providers Providers, interactive bool) bool {
+			return InvestigateWithTools(ctx, sessionLog, providers, interactive)
+		}
+	}
+	if !investigate(ctx, sessionLog, providers, interactive) {
+		sessionLog.EndSession()
+		return sessionLog
+	}
+	if ctx.Err() != nil {
+		log.Warnf("Debug session interrupted: %v", ctx.Err())
+		sessionLog.Summary = "Debug session cancelled before the final analysis."
+		sessionLog.EndSession()
+		printSummary(sessionLog)
+		return sessionLog
+	}
+
+	// The summary is displayed while it is generated
+	summaryStream := ui.NewMarkdownStream(os.Stdout, 100, 2)
+	ui.RunWithStoppableSpinner(interactive, "Performing final analysis", func(stopSpinner func()) {
+		FinalAnalysis(ctx, sessionLog, providers.Summary, func(delta string) {
+			stopSpinner()
+			summaryStream.Write(delta)
+		})
+	})
+	summaryStream.Close()
+	if !summaryStream.Rendered() {
+		// Nothing was streamed, e.g. the final analysis failed
+		printSummary(sessionLog)
+	}
+
+	return sessionLog
+}
+
+// investigateWithBatches runs the batches of commands recommended by the model. It returns
+// false when the user ended the session, in which case no final analysis should be done.
+func investigateWithBatches(ctx context.Context, sessionLog *models.DebugSessionLog, providers Providers, interactive bool) bool {
+	// Each batch only sends its command outputs, the earlier turns are cached by the providers
+	conv := &Conversation{}
 	// For now, loop 5 times to simulate multiple batches
 	for range 5 {
 		// Get the last batch to run commands and analyze
 		currentBatch := sessionLog.LastBatch()
 
-		ui.RunWithSpinner(interactive, "Running commands and analyzing output", func() {
-			RunLastBatch(sessionLog, llmProvider)
+		// In interactive mode, the analysis is displayed while it is generated
+		analysisStream := ui.NewMarkdownStream(os.Stdout, 100, 2)
+		ui.RunWithStoppableSpinner(interactive, "Running commands and analyzing output", func(stopSpinner func()) {
+			var onAnalysis func(string)
+			if interactive {
+				started := false
+				onAnalysis = func(delta string) {
+					if !started {
+						started = true
+						stopSpinner()
+						fmt.Print(string(markdown.Render(batchCommandsMarkdown(currentBatch)+"\n**Analysis:**\n", 100, 2)))
+					}
+					analysisStream.Write(delta)
+				}
+			}
+			RunLastBatch(ctx, sessionLog, providers.Analysis, conv, onAnalysis)
 		})
+		analysisStream.Close()
+
+		if ctx.Err() != nil {
+			return true
+		}
 
 		if interactive {
 			var content strings.Builder
-			content.WriteString("**Commands:**\n")
-			for _, action := range currentBatch.Actions {
-				content.WriteString("- " + action.Name + "\n")
+			if !analysisStream.Rendered() {
+				content.WriteString(batchCommandsMarkdown(currentBatch))
+				content.WriteString("\n**Analysis:**\n")
+				content.WriteString(currentBatch.Analysis + "\n\n")
 			}
-			content.WriteString("\n**Analysis:**\n")
-			content.WriteString(currentBatch.Analysis + "\n\n")
 			content.WriteString("**Next Steps:**\n")
 			for _, cmd := range currentBatch.NextSteps {
 				content.WriteString("- " + cmd + "\n")
 			}
+			content.WriteString(fmt.Sprintf("\n**Tokens used so far:** %d ($%.4f)\n", sessionLog.Usage.TotalTokens(), sessionLog.Usage.Cost))
 
 			rendered := string(markdown.Render(content.String(), 100, 2))
 			fmt.Print(rendered)
 			fmt.Println()
+		}
+
+		if len(currentBatch.NextSteps) > 0 && sessionLog.BudgetExceeded() {
+			log.Warnf("Session budget exceeded (%d tokens, $%.4f), skipping to the final analysis", sessionLog.Usage.TotalTokens(), sessionLog.Usage.Cost)
+			if interactive {
+				fmt.Println("Session budget exceeded, skipping to the final analysis...")
+			}
+			sessionLog.StoppedByBudget = true
+			break
+		}
+
+		if currentBatch.InjectionSuspected && len(currentBatch.NextSteps) > 0 {
+			// The recommendations may come from instructions planted in the outputs
+			if !interactive {
+				log.Warnf("Not running the next commands without a confirmation, skipping to the final analysis")
+				sessionLog.StoppedByInjection = true
+				break
+			}
+			fmt.Print(string(markdown.Render(injectionWarning(currentBatch), 100, 2)))
+		}
+
+		if interactive {
 			fmt.Printf("Do you want to continue with the next batch of commands? (yes/no): ")
 			var response string
 			fmt.Scanln(&response)
 			if response != "yes" {
 				fmt.Println("Ending debug session.")
-				sessionLog.EndSession()
-				return sessionLog
+				return false
 			}
 		}
 
@@ -178,11 +308,38 @@ func DebugWorkflow(issueDescription string, conf *models.DebugSessionConfig, int
 			PrepareNextBatch(sessionLog, currentBatch.NextSteps)
 			time.Sleep(2 * time.Second)
 		})
+		if !hasNewActions(sessionLog.LastBatch()) {
+			log.Infof("All the next commands were already run, skipping to the final analysis")
+			if interactive {
+				fmt.Println("All the next commands were already run, ending debug session...")
+			}
+			break
+		}
+		if sessionLog.Config.SafetyReview {
+			reviewActions(ctx, sessionLog, sessionLog.LastBatch(), providers.Review, interactive)
+		}
 	}
+	return true
+}
 
-	ui.RunWithSpinner(interactive, "Performing final analysis", func() {
-		FinalAnalysis(sessionLog, llmProvider)
-	})
+func batchCommandsMarkdown(batch *models.Batch) string {
+	var content strings.Builder
+	content.WriteString("**Commands:**\n")
+	for _, action := range batch.Actions {
+		content.WriteString("- " + action.Name)
+		switch {
+		case action.Status == models.STATUS_BLOCKED || action.Status == models.STATUS_REJECTED:
+			content.WriteString(" _(" + action.Status + ": " + action.Result + ")_")
+		case action.Status == models.STATUS_DUPLICATE:
+			content.WriteString(" _(already run as " + action.DuplicateOf + ")_")
+		case action.Review != nil && action.Review.Original != "":
+			content.WriteString(" _(rewritten from `" + action.Review.Original + "`)_")
+		}
+		content.WriteString("\n")
+	}
+	return content.String()
+}
 
-	return sessionLog
+func printSummary(sessionLog *models.DebugSessionLog) {
+	fmt.Println(string(markdown.Render(sessionLog.Summary, 100, 2)))
 }
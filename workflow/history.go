@@ -0,0 +1,67 @@
+package workflow
+
+import (
+	"strings"
+
+	"github.com/remijnoel/ailops/models"
+	log "github.com/sirupsen/logrus"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// normalizeCommand returns the command without its comments and with the spacing of the
+// shell printer, so that "ls  -la # disks" and "ls -la" compare equal
+func normalizeCommand(command string) string {
+	file, err := syntax.NewParser(syntax.Variant(syntax.LangBash)).Parse(strings.NewReader(command), "")
+	if err != nil {
+		// Not a valid command line, only the spacing can be normalized
+		return strings.Join(strings.Fields(command), " ")
+	}
+	var buf strings.Builder
+	if err := syntax.NewPrinter(syntax.SingleLine(true)).Print(&buf, file); err != nil {
+		return strings.Join(strings.Fields(command), " ")
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+// markDuplicates marks the new actions of the last batch running a command already run
+// earlier in the session, or earlier in the batch, so that each command runs only once.
+// Blocked, rejected and skipped commands did not run, they may be recommended again.
+func markDuplicates(session *models.DebugSessionLog) {
+	batch := session.LastBatch()
+	if batch == nil {
+		return
+	}
+	seen := map[string]*models.Action{}
+	for _, earlier := range session.Batches[:len(session.Batches)-1] {
+		for _, action := range earlier.Actions {
+			if action.IsCommand() && action.Ran() {
+				seen[normalizeCommand(action.Name)] = action
+			}
+		}
+	}
+	for _, action := range batch.Actions {
+		if !action.IsCommand() || action.Status != models.STATUS_NEW {
+			continue
+		}
+		key := normalizeCommand(action.Name)
+		earlier, ok := seen[key]
+		if !ok {
+			seen[key] = action
+			continue
+		}
+		log.Infof("Not running %q (%s) again, same command as %s", action.Name, action.ID, earlier.ID)
+		action.Status = models.STATUS_DUPLICATE
+		action.DuplicateOf = earlier.ID
+		action.Result = "Already run earlier in the session, see its output there"
+	}
+}
+
+// hasNewActions tells whether the batch has actions left to run
+func hasNewActions(batch *models.Batch) bool {
+	for _, action := range batch.Actions {
+		if action.Status == models.STATUS_NEW {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package workflow
+
+import (
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/remijnoel/ailops/models"
+)
+
+const (
+	OUTPUT_OPENING_TAG = "<command_output>"
+	OUTPUT_CLOSING_TAG = "</command_output>"
+
+	MAX_INJECTION_MATCH_LENGTH = 200 // Characters of a suspicious line kept in the session
+)
+
+// injectionPatterns match text addressed to an LLM rather than to a human reading a log
+var injectionPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\b(ignore|disregard|forget|override)\b.{0,40}\b(previous|prior|above|earlier|all|your)\b.{0,20}\b(instructions?|prompts?|rules|directives)\b`),
+	regexp.MustCompile(`(?i)\b(new|updated|real|actual)\s+(instructions?|system prompt)\b`),
+	regexp.MustCompile(`(?i)\byou\s+(are\s+now|must\s+now|should\s+now)\b`),
+	regexp.MustCompile(`(?i)\b(as\s+an?\s+(ai|llm|language\s+model|assistant))\b`),
+	regexp.MustCompile(`(?i)\b(system\s+prompt|jailbreak|prompt\s+injection)\b`),
+	regexp.MustCompile(`(?i)\b(recommend|run|execute)\s+(the\s+following|this)\s+command`),
+	regexp.MustCompile(`(?i)\b(curl|wget)\b[^|\n]*\|\s*(sudo\s+)?(ba|z|da)?sh\b`),
+	regexp.MustCompile(`(?i)</?\s*(system|assistant|user|instructions?)\s*>`),
+	regexp.MustCompile(`(?i)\[/?INST\]|<\|im_(start|end)\|>|###\s*(system|instruction)`),
+	regexp.MustCompile(`(?i)` + regexp.QuoteMeta(OUTPUT_CLOSING_TAG)),
+}
+
+// promptFuncs are the functions available to the prompt templates
+var promptFuncs = template.FuncMap{
+	"untrusted": QuoteOutput,
+}
+
+var outputTagPattern = regexp.MustCompile(`(?i)<(\s*/?\s*)command_output`)
+
+// QuoteOutput encloses a command output in the delimiters of untrusted data. The
+// delimiters found in the output are escaped, so that the output cannot close them.
+func QuoteOutput(output string) string {
+	escaped := outputTagPattern.ReplaceAllString(output, "&lt;${1}command_output")
+	return OUTPUT_OPENING_TAG + "\n" + escaped + "\n" + OUTPUT_CLOSING_TAG
+}
+
+// DetectInjection returns the lines of the output that look like instructions to an LLM
+func DetectInjection(output string) []string {
+	var matches []string
+	for _, line := range strings.Split(output, "\n") {
+		for _, pattern := range injectionPatterns {
+			if pattern.MatchString(line) {
+				line = strings.TrimSpace(line)
+				if len(line) > MAX_INJECTION_MATCH_LENGTH {
+					line = line[:MAX_INJECTION_MATCH_LENGTH] + "..."
+				}
+				matches = append(matches, line)
+				break
+			}
+		}
+	}
+	return matches
+}
+
+// flagInjections runs the detector on the outputs of the batch, and returns whether
+// any of them looks like a prompt injection
+func flagInjections(batch *models.Batch, conf *models.DebugSessionConfig) bool {
+	if conf.DisableInjectionDetection {
+		return false
+	}
+	for _, action := range batch.Actions {
+		if !action.Ran() {
+			continue
+		}
+		action.Injection = DetectInjection(action.Output())
+		if len(action.Injection) > 0 {
+			batch.InjectionSuspected = true
+		}
+	}
+	return batch.InjectionSuspected
+}
+
+// injectionWarning describes the suspicious lines of the batch to the user
+func injectionWarning(batch *models.Batch) string {
+	var b strings.Builder
+	b.WriteString("**Warning:** the output of these commands contains instruction-like text, the recommendations may have been manipulated:\n")
+	for _, action := range batch.Actions {
+		for _, line := range action.Injection {
+			b.WriteString("- `" + action.Name + "`: " + line + "\n")
+		}
+	}
+	return b.String()
+}
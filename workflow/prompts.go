@@ -0,0 +1,206 @@
+package workflow
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/remijnoel/ailops/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// PROMPT_FILE_EXTENSION is the extension of the template files of a prompts directory
+const PROMPT_FILE_EXTENSION = ".tmpl"
+
+// SystemPrompt is sent before the messages of every LLM request
+var SystemPrompt = "You are a Linux system assistant. Analyze the following system diagnostics and provide a clear, concise summary of system health, notable issues, and recommended actions."
+
+// Prompt is a prompt template of the workflow that can be overridden by a file
+type Prompt struct {
+	Name        string
+	Description string
+	Default     string                            // Compiled-in template
+	Source      string                            // File the template was loaded from, empty for the default
+	text        *string                           // Template used by the workflow
+	data        func(*models.DebugSessionLog) any // Data the template is rendered with
+}
+
+// Prompts lists the prompt templates, in the order they are used by a session
+var Prompts = []*Prompt{
+	{
+		Name:        "system",
+		Description: "System prompt sent before every request (plain text)",
+		Default:     SystemPrompt,
+		text:        &SystemPrompt,
+		data:        func(*models.DebugSessionLog) any { return nil },
+	},
+	{
+		Name:        "command_analysis",
+		Description: "Analysis of a batch of commands, rendered with a CommandAnalysisInput",
+		Default:     commandAnalysisPrompt,
+		text:        &commandAnalysisPrompt,
+		data: func(session *models.DebugSessionLog) any {
+			return CommandAnalysisInput{Session: session, IncludeAllBatchAnalysis: true, IncludeAllCommandOutputs: true}
+		},
+	},
+	{
+		Name:        "batch_results",
+		Description: "Follow-up turn of the analysis conversation, rendered with the last Batch",
+		Default:     BatchResultsPrompt,
+		text:        &BatchResultsPrompt,
+		data:        func(session *models.DebugSessionLog) any { return session.LastBatch() },
+	},
+	{
+		Name:        "command_review",
+		Description: "Safety review of the recommended commands, rendered with a CommandReviewInput",
+		Default:     CommandReviewPrompt,
+		text:        &CommandReviewPrompt,
+		data: func(session *models.DebugSessionLog) any {
+			return CommandReviewInput{Session: session, Commands: session.LastBatch().NextSteps}
+		},
+	},
+	{
+		Name:        "history_summary",
+		Description: "Summary of the debugging history when it exceeds the context, rendered with a HistorySummaryInput",
+		Default:     HistorySummaryPrompt,
+		text:        &HistorySummaryPrompt,
+		data: func(session *models.DebugSessionLog) any {
+			return HistorySummaryInput{Session: session, EarlierHistory: session.HistorySummary, Batches: session.Batches}
+		},
+	},
+	{
+		Name:        "tool_investigation",
+		Description: "First message of the tools investigation mode, rendered with the DebugSessionLog",
+		Default:     toolInvestigationPrompt,
+		text:        &toolInvestigationPrompt,
+		data:        func(session *models.DebugSessionLog) any { return session },
+	},
+	{
+		Name:        "final_analysis",
+		Description: "Final analysis of the session, rendered with the DebugSessionLog",
+		Default:     FinalAnalysisPrompt,
+		text:        &FinalAnalysisPrompt,
+		data:        func(session *models.DebugSessionLog) any { return session },
+	},
+}
+
+// LookupPrompt returns the prompt template with this name
+func LookupPrompt(name string) (*Prompt, error) {
+	for _, p := range Prompts {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	names := make([]string, 0, len(Prompts))
+	for _, p := range Prompts {
+		names = append(names, p.Name)
+	}
+	return nil, fmt.Errorf("unknown prompt %q, available prompts are: %s", name, strings.Join(names, ", "))
+}
+
+// Text returns the template used by the workflow
+func (p *Prompt) Text() string {
+	return *p.text
+}
+
+// Render executes the template with the data of the session
+func (p *Prompt) Render(session *models.DebugSessionLog) (string, error) {
+	return renderPrompt(p.Name, *p.text, p.data(session))
+}
+
+// Validate parses the template and renders it with a sample session, so that a template
+// referring to unknown fields fails at startup rather than in the middle of a session
+func (p *Prompt) Validate(text string) error {
+	_, err := renderPrompt(p.Name, text, p.data(sampleSession()))
+	return err
+}
+
+// LoadPrompts replaces the default templates by the "<name>.tmpl" files of dir. Every file
+// is validated before any template is replaced.
+func LoadPrompts(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read the prompts directory: %w", err)
+	}
+
+	loaded := map[*Prompt]string{}
+	var errs []error
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != PROMPT_FILE_EXTENSION {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		prompt, err := LookupPrompt(strings.TrimSuffix(entry.Name(), PROMPT_FILE_EXTENSION))
+		if err != nil {
+			log.Warnf("Ignoring %s: %v", path, err)
+			continue
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to read %s: %w", path, err))
+			continue
+		}
+		if err := prompt.Validate(string(content)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			continue
+		}
+		loaded[prompt] = path
+		*prompt.text = string(content)
+	}
+	if len(errs) > 0 {
+		// Keep the defaults when a template is invalid
+		for prompt := range loaded {
+			*prompt.text = prompt.Default
+		}
+		return errors.Join(errs...)
+	}
+	for prompt, path := range loaded {
+		prompt.Source = path
+		log.Infof("Using the %s prompt from %s", prompt.Name, path)
+	}
+	return nil
+}
+
+func renderPrompt(name string, text string, data any) (string, error) {
+	tmpl, err := template.New(name).Funcs(promptFuncs).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid template: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render template: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// sampleSession returns a session where every list holds an element, so that validating
+// a template executes the body of its range and with blocks
+func sampleSession() *models.DebugSessionLog {
+	batch := &models.Batch{
+		Description: "Initial commands",
+		Actions: []*models.Action{
+			{Name: "uptime", ActionType: "command", Status: models.STATUS_COMPLETED, Stdout: "up 3 days"},
+		},
+		Analysis:  "The host is up",
+		NextSteps: []string{"df -h"},
+		Completed: true,
+		Failovers: []models.Failover{{Provider: "openai", Error: "timeout"}},
+	}
+	return &models.DebugSessionLog{
+		ID:               "sample",
+		IssueDescription: "The host is slow",
+		Batches:          []*models.Batch{batch},
+		HistorySummary:   "Nothing found yet",
+		Summary:          "The host is fine",
+		Config: &models.DebugSessionConfig{
+			FirstCommands:    []string{"uptime"},
+			CommandWhitelist: []string{"df"},
+			CommandBlacklist: []string{"rm"},
+			ModelPricing:     []models.ModelPrice{{Model: "gpt-4.1-mini"}},
+		},
+	}
+}
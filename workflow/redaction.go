@@ -0,0 +1,27 @@
+package workflow
+
+import (
+	"github.com/remijnoel/ailops/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// redactOutputs replaces the secrets of the errors of the actions by placeholders, and
+// updates the redaction summary of the session. The outputs themselves are redacted by the
+// executor while they are streamed, before they are truncated or spilled to files.
+func redactOutputs(session *models.DebugSessionLog, actions []*models.Action) {
+	redactor := session.Config.Redactor
+	if redactor == nil {
+		return
+	}
+	for _, action := range actions {
+		action.Result = redactor.Redact(action.Result)
+	}
+
+	session.Redactions = session.Redactions[:0]
+	for _, f := range redactor.Findings() {
+		session.Redactions = append(session.Redactions, models.Redaction{Kind: f.Kind, Values: f.Values, Occurrences: f.Occurrences})
+	}
+	if len(session.Redactions) > 0 {
+		log.Debugf("Redacted secrets so far: %+v", session.Redactions)
+	}
+}
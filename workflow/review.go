@@ -0,0 +1,165 @@
+package workflow
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/remijnoel/ailops/llm"
+	"github.com/remijnoel/ailops/models"
+	"github.com/remijnoel/ailops/ui"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	VERDICT_SAFE         = "safe"
+	VERDICT_UNSAFE       = "unsafe"
+	VERDICT_NEEDS_REVIEW = "needs_review"
+
+	UNSAFE_COMMANDS_REJECT  = "reject"  // Unsafe commands without a rewrite are not run
+	UNSAFE_COMMANDS_CONFIRM = "confirm" // Unsafe commands without a rewrite are run when the user confirms them
+)
+
+var CommandReviewPrompt = `You are reviewing the shell commands that an assistant wants to run on a Linux host to debug an issue. The investigation must never alter the state of the host.
+
+Give a verdict for each command:
+- "safe": the command only reads the state of the system and its output is bounded.
+- "unsafe": the command may alter the system (write or delete files, change the configuration, start, stop or kill processes, install packages, ...), expose secrets, or put a heavy load on the host.
+- "needs_review": the effect of the command cannot be determined, e.g. it runs an unknown script or binary.
+
+Explain each verdict in one sentence. When a command is not safe and a read-only command gives the same diagnostic information, put it in "rewrite", otherwise leave "rewrite" empty.
+Review every command, in the order given, and copy it as-is in "command".
+
+Problem description: {{.Session.IssueDescription}}
+
+Commands:
+{{range .Commands}}
+- {{.}}
+{{end}}`
+
+type CommandReviewInput struct {
+	Session  *models.DebugSessionLog
+	Commands []string // Commands to review
+}
+
+type CommandReview struct {
+	Command   string `json:"command" jsonschema_description:"The reviewed command, as given"`
+	Verdict   string `json:"verdict" jsonschema:"enum=safe,enum=unsafe,enum=needs_review" jsonschema_description:"Whether the command can be run without altering the host"`
+	Reasoning string `json:"reasoning" jsonschema_description:"Why the command received this verdict"`
+	Rewrite   string `json:"rewrite" jsonschema_description:"Read-only command giving the same information when the command is not safe, empty otherwise"`
+}
+
+type CommandReviewResponse struct {
+	Reviews []CommandReview `json:"reviews" jsonschema_description:"One review per command, in the order of the commands"`
+}
+
+// ReviewCommands asks the LLM for a safety verdict on each command
+func ReviewCommands(ctx context.Context, session *models.DebugSessionLog, commands []string, provider llm.Provider) ([]CommandReview, error) {
+	prompt, err := renderPrompt("commandReview", CommandReviewPrompt, CommandReviewInput{Session: session, Commands: commands})
+	if err != nil {
+		return nil, err
+	}
+	res, err := provider.RequestCompletionWithJSONSchema(ctx, prompt, llm.GenerateSchema[CommandReviewResponse]())
+	if err != nil {
+		return nil, fmt.Errorf("error reviewing commands: %w", err)
+	}
+	var response CommandReviewResponse
+	if err := json.Unmarshal([]byte(res), &response); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return response.Reviews, nil
+}
+
+// reviewActions reviews the commands of the batch that are not blocked or rejected yet. Commands that
+// are not safe are replaced by their read-only rewrite when there is one, otherwise they
+// are rejected or, in interactive mode, run only when the user confirms them. When the
+// review fails, every command needs to be confirmed.
+func reviewActions(ctx context.Context, session *models.DebugSessionLog, batch *models.Batch, provider llm.Provider, interactive bool) {
+	var pending []*models.Action
+	var commands []string
+	for _, action := range batch.Actions {
+		if action.Status == models.STATUS_NEW {
+			pending = append(pending, action)
+			commands = append(commands, action.Name)
+		}
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	recorder := &llm.CallRecorder{}
+	var reviews []CommandReview
+	var err error
+	ui.RunWithSpinner(interactive, "Reviewing commands", func() {
+		reviews, err = ReviewCommands(llm.WithCallRecorder(ctx, recorder), session, commands, provider)
+	})
+	usage := tokenUsage(recorder.Calls(), session.Config)
+	batch.Usage.Add(usage)
+	session.Usage.Add(usage)
+	model, _ := answeredBy(recorder.Calls(), provider)
+	if err != nil {
+		log.Errorf("Failed to review commands: %v", err)
+	}
+
+	var confirm func(*models.Action) bool
+	if interactive {
+		confirm = confirmFlaggedCommand
+	}
+	for i, action := range pending {
+		review, ok := findReview(reviews, i, action.Name)
+		switch {
+		case err != nil:
+			review = CommandReview{Verdict: VERDICT_NEEDS_REVIEW, Reasoning: "The safety review failed: " + err.Error()}
+		case !ok:
+			review = CommandReview{Verdict: VERDICT_NEEDS_REVIEW, Reasoning: "The reviewer did not return a verdict for this command"}
+		}
+		applyReview(action, review, model, session.Config, confirm)
+	}
+}
+
+// findReview returns the review of the command, matched by its text or else by its position
+func findReview(reviews []CommandReview, i int, command string) (CommandReview, bool) {
+	for _, review := range reviews {
+		if review.Command == command {
+			return review, true
+		}
+	}
+	if i < len(reviews) && reviews[i].Command == "" {
+		return reviews[i], true
+	}
+	return CommandReview{}, false
+}
+
+func applyReview(action *models.Action, review CommandReview, model string, conf *models.DebugSessionConfig, confirm func(*models.Action) bool) {
+	action.Review = &models.SafetyReview{
+		Verdict:   review.Verdict,
+		Reasoning: review.Reasoning,
+		Rewrite:   review.Rewrite,
+		Model:     model,
+	}
+	switch {
+	case review.Verdict == VERDICT_SAFE:
+	case review.Rewrite != "" && review.Rewrite != action.Name:
+		log.Infof("Replacing %q (%s) by its read-only rewrite %q", action.Name, review.Verdict, review.Rewrite)
+		action.Review.Original = action.Name
+		action.Name = review.Rewrite
+	case review.Verdict == VERDICT_UNSAFE && conf.UnsafeCommands != UNSAFE_COMMANDS_CONFIRM:
+		log.Warnf("Rejecting unsafe command %q: %s", action.Name, review.Reasoning)
+		action.Status = models.STATUS_REJECTED
+		action.Result = "Rejected by the safety review: " + review.Reasoning
+	case confirm != nil && confirm(action):
+		action.Review.Confirmed = true
+	default:
+		log.Warnf("Rejecting command %q flagged by the safety review (%s): %s", action.Name, review.Verdict, review.Reasoning)
+		action.Status = models.STATUS_REJECTED
+		action.Result = "Rejected by the safety review: " + review.Reasoning
+	}
+}
+
+func confirmFlaggedCommand(action *models.Action) bool {
+	fmt.Printf("The safety review flagged %q as %s: %s\n", action.Name, action.Review.Verdict, action.Review.Reasoning)
+	fmt.Printf("Do you want to run it anyway? (yes/no): ")
+	var response string
+	fmt.Scanln(&response)
+	return response == "yes"
+}
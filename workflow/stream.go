@@ -0,0 +1,140 @@
+package workflow
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonFieldStream extracts the value of a top-level string field from a JSON document
+// received in chunks, so that the field can be displayed while the document is generated
+type jsonFieldStream struct {
+	key     string
+	onValue func(string) // Called with each decoded chunk of the field value
+	buf     strings.Builder
+	pos     int  // Position of the next byte to look at in buf
+	inValue bool // pos is inside the field value
+	done    bool
+}
+
+func newJSONFieldStream(key string, onValue func(string)) *jsonFieldStream {
+	return &jsonFieldStream{key: key, onValue: onValue}
+}
+
+func (s *jsonFieldStream) Write(chunk string) {
+	if s.done {
+		return
+	}
+	s.buf.WriteString(chunk)
+	data := s.buf.String()
+
+	if !s.inValue {
+		start, ok := findStringValue(data, s.key)
+		if !ok {
+			return
+		}
+		s.pos = start
+		s.inValue = true
+	}
+
+	var value strings.Builder
+	for s.pos < len(data) {
+		c := data[s.pos]
+		if c == '"' {
+			s.done = true
+			break
+		}
+		if c != '\\' {
+			_, size := utf8.DecodeRuneInString(data[s.pos:])
+			if size == 1 && c >= utf8.RuneSelf && !utf8.FullRuneInString(data[s.pos:]) {
+				break // Wait for the rest of the multi-byte character
+			}
+			value.WriteString(data[s.pos : s.pos+size])
+			s.pos += size
+			continue
+		}
+		decoded, size, ok := decodeEscape(data[s.pos:])
+		if !ok {
+			break // Wait for the rest of the escape sequence
+		}
+		value.WriteString(decoded)
+		s.pos += size
+	}
+	if value.Len() > 0 {
+		s.onValue(value.String())
+	}
+}
+
+// findStringValue returns the position right after the opening quote of the string value of key
+func findStringValue(data string, key string) (int, bool) {
+	quoted := strconv.Quote(key)
+	offset := 0
+	for {
+		i := strings.Index(data[offset:], quoted)
+		if i < 0 {
+			return 0, false
+		}
+		i += offset + len(quoted)
+		j := skipSpaces(data, i)
+		if j >= len(data) {
+			return 0, false
+		}
+		if data[j] == ':' {
+			k := skipSpaces(data, j+1)
+			if k >= len(data) {
+				return 0, false
+			}
+			if data[k] == '"' {
+				return k + 1, true
+			}
+		}
+		offset = i
+	}
+}
+
+func skipSpaces(data string, i int) int {
+	for i < len(data) && strings.ContainsRune(" \t\r\n", rune(data[i])) {
+		i++
+	}
+	return i
+}
+
+// decodeEscape decodes the JSON escape sequence at the start of s
+func decodeEscape(s string) (string, int, bool) {
+	if len(s) < 2 {
+		return "", 0, false
+	}
+	if s[1] == 'u' {
+		if len(s) < 6 {
+			return "", 0, false
+		}
+		// Surrogate pairs are decoded together
+		if high := strings.ToUpper(s[2:4]); (high == "D8" || high == "D9" || high == "DA" || high == "DB") && len(s) < 12 {
+			return "", 0, false
+		}
+		if len(s) >= 12 && s[6] == '\\' && s[7] == 'u' {
+			if decoded, err := strconv.Unquote(`"` + s[:12] + `"`); err == nil && utf8.RuneCountInString(decoded) == 1 {
+				return decoded, 12, true
+			}
+		}
+		decoded, err := strconv.Unquote(`"` + s[:6] + `"`)
+		if err != nil {
+			return "�", 6, true
+		}
+		return decoded, 6, true
+	}
+	switch s[1] {
+	case 'n':
+		return "\n", 2, true
+	case 't':
+		return "\t", 2, true
+	case 'r':
+		return "\r", 2, true
+	case 'b':
+		return "\b", 2, true
+	case 'f':
+		return "\f", 2, true
+	default: // \" \\ \/
+		return s[1:2], 2, true
+	}
+}
@@ -0,0 +1,38 @@
+package workflow
+
+import (
+	"github.com/remijnoel/ailops/llm"
+	"github.com/remijnoel/ailops/models"
+)
+
+// tokenUsage sums up the recorded LLM calls, priced with the session configuration
+func tokenUsage(calls []llm.Call, conf *models.DebugSessionConfig) models.TokenUsage {
+	var usage models.TokenUsage
+	for _, call := range calls {
+		usage.Add(models.TokenUsage{
+			PromptTokens:     call.Usage.PromptTokens,
+			CompletionTokens: call.Usage.CompletionTokens,
+			Cost:             conf.Cost(call.Model, call.Usage.PromptTokens, call.Usage.CompletionTokens),
+			Calls:            1,
+		})
+	}
+	return usage
+}
+
+// answeredBy returns the model and provider of the last recorded call, which is the one
+// that answered when fallback providers are configured
+func answeredBy(calls []llm.Call, provider llm.Provider) (string, string) {
+	if len(calls) == 0 {
+		return provider.Model().Name, ""
+	}
+	last := calls[len(calls)-1]
+	return last.Model, last.Provider
+}
+
+func failovers(recorder *llm.CallRecorder) []models.Failover {
+	var res []models.Failover
+	for _, f := range recorder.Failovers() {
+		res = append(res, models.Failover{Provider: f.Provider, Error: f.Err.Error()})
+	}
+	return res
+}